@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"time"
+
+	work "blockchain-app/Work"
+)
+
+// Fetch a header template from the node
+func getWork(node string) (work.Template, error) {
+	var template work.Template
+
+	resp, err := http.Get(node + "/work")
+	if err != nil {
+		return template, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return template, fmt.Errorf("node returned %s", resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&template)
+	return template, err
+}
+
+// Send a solved nonce to the node
+func submitWork(node string, submission work.Submission) (work.Result, error) {
+	var result work.Result
+
+	data, err := json.Marshal(submission)
+	if err != nil {
+		return result, err
+	}
+
+	resp, err := http.Post(node+"/submit", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	return result, err
+}
+
+// Search the nonces of the template across the workers until one is found or the context ends
+func search(ctx context.Context, template work.Template, workers int) (int32, bool) {
+	nonce, _, found := work.Search(ctx, template.Prefix, template.Suffix, template.Difficulty, workers)
+	return nonce, found
+}
+
+func main() {
+	node := flag.String("node", "http://127.0.0.1:8545", "Work server of the node")
+	threads := flag.Int("threads", runtime.NumCPU(), "Number of goroutines mining in parallel")
+	refresh := flag.Duration("refresh", 10*time.Second, "How long to mine a template before asking for a fresh one")
+	flag.Parse()
+
+	if *threads < 1 {
+		log.Fatalf("Threads must be at least 1")
+	}
+
+	for {
+		template, err := getWork(*node)
+		if err != nil {
+			fmt.Println("Failed to get work:", err)
+			time.Sleep(2 * time.Second)
+			continue
+		}
+
+		// Mine the template for a while, then pick up the new transactions or tip
+		ctx, cancel := context.WithTimeout(context.Background(), *refresh)
+		nonce, found := search(ctx, template, *threads)
+		cancel()
+
+		if !found {
+			continue
+		}
+
+		result, err := submitWork(*node, work.Submission{Job_id: template.Job_id, Nonce: nonce})
+		if err != nil {
+			fmt.Println("Failed to submit work:", err)
+			continue
+		}
+
+		if result.Accepted {
+			fmt.Printf("Block %d accepted: %s\n", template.Block_height, result.Block_hash)
+		} else {
+			fmt.Printf("Block %d rejected: %s\n", template.Block_height, result.Error)
+		}
+	}
+}
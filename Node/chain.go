@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Block whose parent is not known, which may still be valid
+var errOrphanBlock = errors.New("previous hash does not match")
+
+// Add a block to the blockchain, moving the tip to it if it extends the chain or the engine prefers its fork.
+// Reports whether the tip changed.
+func acceptBlock(block Block) (bool, error) {
+	ChainMutex.Lock()
+	defer ChainMutex.Unlock()
+
+	BlockMutex.RLock()
+	_, exists := Blockchain[block.Block_hash]
+	tip := Blockchain[Latest_Block]
+	previousBlock, linked := Blockchain[block.Previous_hash]
+	BlockMutex.RUnlock()
+
+	if exists {
+		return false, nil
+	}
+
+	if !linked || block.Block_height != previousBlock.Block_height+1 {
+		return false, errOrphanBlock
+	}
+
+	err := Engine.VerifySeal(block)
+	if err != nil {
+		return false, err
+	}
+
+	// The block extends the current chain
+	if block.Previous_hash == tip.Block_hash {
+		err = validateBlockBody(block)
+		if err != nil {
+			return false, err
+		}
+
+		BlockMutex.Lock()
+		Blockchain[block.Block_hash] = block
+		BlockMutex.Unlock()
+
+		connectBlock(block)
+		return true, nil
+	}
+
+	// The block is on a fork - its transactions are validated against the fork when switching to it,
+	// so only the checks independent of the chain state run before keeping it
+	err = checkBlockSanity(block)
+	if err != nil {
+		return false, err
+	}
+
+	BlockMutex.Lock()
+	Blockchain[block.Block_hash] = block
+	BlockMutex.Unlock()
+
+	if !Engine.ChooseFork(tip, block) {
+		return false, nil
+	}
+
+	err = reorganize(block)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Apply a block on top of the current tip
+func connectBlock(block Block) {
+	// Move the transactions out of the mempool and update the UTXOs
+	removeFromMempool(block)
+
+	// Save the merkle tree of the block
+	MerkleRoot := buildMerkle(block.Transactions)
+	MerkleMutex.Lock()
+	Merkle_Roots[MerkleRoot.Value] = MerkleRoot
+	MerkleMutex.Unlock()
+
+	BlockMutex.Lock()
+	Latest_Block = block.Block_hash
+	Block_Heights[block.Block_height] = block.Block_hash
+	BlockMutex.Unlock()
+
+	// The auto miner has to build on the new tip
+	notifyTemplate()
+}
+
+// Undo the tip block, restoring the UTXOs it spent. Its transactions are returned to the mempool by resubmitTransactions.
+func disconnectBlock(block Block) {
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		txn := block.Transactions[i]
+
+		// Destroy the UTXOs created by the transaction
+		UTXOMutex.Lock()
+		for idx := range txn.Outputs {
+			delete(UTXO_SET, utxoKey(txn.Txn_id, int32(idx)))
+		}
+		UTXOMutex.Unlock()
+
+		// Restore the UTXOs spent by the transaction
+		for _, input := range txn.Inputs {
+			TransMutex.RLock()
+			previousTxn, exists := Transactions[input.Txn_id]
+			TransMutex.RUnlock()
+
+			if !exists || int(input.Index) >= len(previousTxn.Outputs) {
+				continue
+			}
+
+			BlockMutex.RLock()
+			height := Blockchain[previousTxn.Block_hash].Block_height
+			BlockMutex.RUnlock()
+
+			UTXOMutex.Lock()
+			UTXO_SET[utxoKey(input.Txn_id, input.Index)] = newUTXO(input.Txn_id, input.Index, previousTxn.Outputs[input.Index], height)
+			UTXOMutex.Unlock()
+		}
+
+		TransMutex.Lock()
+		delete(Transactions, txn.Txn_id)
+		TransMutex.Unlock()
+	}
+
+	BlockMutex.Lock()
+	Latest_Block = block.Previous_hash
+	delete(Block_Heights, block.Block_height)
+	BlockMutex.Unlock()
+}
+
+// Switch the chain to the fork ending at newTip
+func reorganize(newTip Block) error {
+	BlockMutex.RLock()
+
+	// Blocks of the current chain
+	mainChain := map[string]bool{}
+	for hash := Latest_Block; hash != ""; hash = Blockchain[hash].Previous_hash {
+		mainChain[hash] = true
+	}
+
+	// Blocks of the fork, from the fork point up to the new tip
+	branch := []Block{}
+	block := newTip
+	for !mainChain[block.Block_hash] {
+		branch = append([]Block{block}, branch...)
+
+		previousBlock, exists := Blockchain[block.Previous_hash]
+		if !exists {
+			BlockMutex.RUnlock()
+			return fmt.Errorf("fork block %s references a missing block %s", block.Block_hash, block.Previous_hash)
+		}
+		block = previousBlock
+	}
+	forkPoint := block.Block_hash
+
+	BlockMutex.RUnlock()
+
+	// Undo the current chain down to the fork point
+	disconnected := []Block{}
+	for {
+		BlockMutex.RLock()
+		tip := Blockchain[Latest_Block]
+		BlockMutex.RUnlock()
+
+		if tip.Block_hash == forkPoint {
+			break
+		}
+
+		disconnectBlock(tip)
+		disconnected = append(disconnected, tip)
+	}
+
+	// Apply the fork
+	for idx, block := range branch {
+		err := validateBlockBody(block)
+		if err == nil {
+			connectBlock(block)
+			continue
+		}
+
+		// Restore the previous chain
+		for j := idx - 1; j >= 0; j-- {
+			disconnectBlock(branch[j])
+		}
+		for j := len(disconnected) - 1; j >= 0; j-- {
+			connectBlock(disconnected[j])
+		}
+		resubmitTransactions(branch[:idx])
+
+		// Forget the invalid block and the fork blocks built on it
+		BlockMutex.Lock()
+		for _, invalid := range branch[idx:] {
+			delete(Blockchain, invalid.Block_hash)
+		}
+		BlockMutex.Unlock()
+
+		return fmt.Errorf("fork block %s is invalid: %v", block.Block_hash, err)
+	}
+
+	// The transactions of the undone blocks, lowest block first, that the new chain does not confirm
+	undone := make([]Block, 0, len(disconnected))
+	for j := len(disconnected) - 1; j >= 0; j-- {
+		undone = append(undone, disconnected[j])
+	}
+	resubmitTransactions(undone)
+
+	fmt.Printf("\x1b[33m> Chain reorganized\n> Fork point: %s\n> Blocks undone: %d\n> New tip: %s\x1b[0m\n", forkPoint, len(disconnected), newTip.Block_hash)
+	return nil
+}
+
+// Return the transactions of disconnected blocks to the mempool through the admission checks, against the new tip.
+// The blocks are given lowest first, so that parents are admitted before their children; the transactions failing
+// the checks are dropped.
+func resubmitTransactions(blocks []Block) {
+	dropped := 0
+
+	for _, block := range blocks {
+		for _, txn := range block.Transactions {
+			// The coinbase is only valid in its own block
+			if isCoinbase(txn) {
+				continue
+			}
+
+			txn.Block_hash = ""
+			err := acceptToMempool(txn)
+			if err != nil && !isDuplicate(err) {
+				dropped++
+			}
+		}
+	}
+
+	if dropped > 0 {
+		fmt.Printf("\x1b[33m> Dropped %d transaction(s) of the disconnected blocks\x1b[0m\n", dropped)
+	}
+}
+
+// Add a locally sealed block to the chain and announce it to the peers
+func submitBlock(block Block) error {
+	tipChanged, err := acceptBlock(block)
+	if err != nil {
+		return fmt.Errorf("sealed block is invalid: %v", err)
+	}
+
+	if !tipChanged {
+		return fmt.Errorf("block at the height is already mined!! Please try again")
+	}
+
+	relayBlock(newBlockDTO(block))
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+const (
+	connGracePeriod     = time.Minute      // Age before which a new connection is never trimmed
+	peerCheckInterval   = 30 * time.Second // Time between the searches for peers once there are enough
+	peerManageInterval  = time.Minute      // Time between the updates of the peer values and protections
+	peerIdleTime        = 10 * time.Minute // Time without hearing from a peer after which it loses its activity value
+	protectedLongLived  = 4                // Inbound peers protected for being connected the longest
+	protectedDiverse    = 4                // Inbound peers protected for being in distinct network groups
+	maxUsefulValue      = 50               // Cap of the value a peer earns by relaying valid items
+	readyPeerValue      = 20               // Value of a peer that completed the handshake
+	activePeerValue     = 10               // Value of a peer heard from recently
+	misbehaviorDivisor  = 5                // Misbehavior points costing a point of value
+	connValueTag        = "value"          // Connection manager tag holding the value of a peer
+	protectOutboundTag  = "outbound"       // Protection of the peers the node chose to connect to
+	protectLongLivedTag = "long-lived"     // Protection of the longest connected inbound peers
+	protectDiverseTag   = "diverse"        // Protection of the inbound peers of distinct network groups
+)
+
+// Connection manager trimming the lowest value connections when there are more than the maximum peers
+func newConnManager() (*connmgr.BasicConnMgr, error) {
+	if config.MinPeers > config.MaxPeers {
+		return nil, fmt.Errorf("minimum peers %d is above the maximum %d", config.MinPeers, config.MaxPeers)
+	}
+
+	return connmgr.NewConnManager(config.MinPeers, config.MaxPeers, connmgr.WithGracePeriod(connGracePeriod))
+}
+
+// Network group of an address - the /16 of an IPv4 address, or the /32 of an IPv6 address
+func netGroup(addr multiaddr.Multiaddr) string {
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		return addr.String()
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(16, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(32, 128)).String()
+}
+
+// Check whether the discovery should look for more peers - while the outbound slots are not all used,
+// or there are fewer peers than the minimum
+func needPeers() bool {
+	peerMutex.RLock()
+	defer peerMutex.RUnlock()
+
+	total, outbound := 0, 0
+	for _, entry := range peerTable {
+		if !entry.Ready {
+			continue
+		}
+
+		total++
+		if !entry.Inbound {
+			outbound++
+		}
+	}
+
+	return outbound < config.OutboundSlots || total < config.MinPeers
+}
+
+// Credit a peer for a valid transaction or block it relayed first
+func creditPeer(peerID peer.ID) {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+
+	if entry, exists := peerTable[peerID.String()]; exists {
+		entry.Useful++
+	}
+}
+
+// Value of a peer for the connection manager - the lowest values are trimmed first
+func peerValue(entry PeerEntry, score int) int {
+	value := 0
+	if entry.Ready {
+		value += readyPeerValue
+	}
+
+	if time.Since(entry.Last_seen) < peerIdleTime {
+		value += activePeerValue
+	}
+
+	value += min(entry.Useful, maxUsefulValue)
+	value -= score / misbehaviorDivisor
+
+	return value
+}
+
+// Keep the values and protections of the peers up to date
+func managePeers() {
+	for {
+		time.Sleep(peerManageInterval)
+		decayScores()
+		updatePeerValues()
+	}
+}
+
+func updatePeerValues() {
+	peerMutex.RLock()
+	entries := make([]PeerEntry, 0, len(peerTable))
+	for _, entry := range peerTable {
+		entries = append(entries, *entry)
+	}
+	peerMutex.RUnlock()
+
+	BanMutex.RLock()
+	scores := make(map[peer.ID]int, len(entries))
+	for _, entry := range entries {
+		scores[entry.Info.ID] = Peer_Scores[entry.Info.ID.String()]
+	}
+	BanMutex.RUnlock()
+
+	manager := User.ConnManager()
+
+	// Well behaved inbound peers are candidates for the protection
+	candidates := []PeerEntry{}
+	for _, entry := range entries {
+		manager.TagPeer(entry.Info.ID, connValueTag, peerValue(entry, scores[entry.Info.ID]))
+		manager.Unprotect(entry.Info.ID, protectLongLivedTag)
+		manager.Unprotect(entry.Info.ID, protectDiverseTag)
+
+		if entry.Ready && entry.Inbound && scores[entry.Info.ID] == 0 {
+			candidates = append(candidates, entry)
+		}
+	}
+
+	// The peers connected the longest
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Connected.Before(candidates[j].Connected)
+	})
+	for _, entry := range candidates[:min(protectedLongLived, len(candidates))] {
+		manager.Protect(entry.Info.ID, protectLongLivedTag)
+	}
+
+	// The most useful peer of each network group, so that a single network cannot take all the slots
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Useful > candidates[j].Useful
+	})
+	groups := map[string]bool{}
+	for _, entry := range candidates {
+		if len(groups) == protectedDiverse {
+			break
+		}
+		if groups[entry.Group] {
+			continue
+		}
+
+		groups[entry.Group] = true
+		manager.Protect(entry.Info.ID, protectDiverseTag)
+	}
+}
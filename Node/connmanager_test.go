@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+func TestNetGroup(t *testing.T) {
+	tests := map[string]string{
+		"/ip4/203.0.113.7/tcp/4001":         "203.0.0.0",
+		"/ip4/203.0.200.9/udp/4001/quic-v1": "203.0.0.0",
+		"/ip6/2001:db8:1:2::1/tcp/4001":     "2001:db8::",
+		"/dns4/node.example/tcp/4001":       "/dns4/node.example/tcp/4001",
+	}
+
+	for addr, want := range tests {
+		if group := netGroup(multiaddr.StringCast(addr)); group != want {
+			t.Errorf("group of %s is %s, want %s", addr, group, want)
+		}
+	}
+}
+
+func TestPeerValue(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name  string
+		entry PeerEntry
+		score int
+		want  int
+	}{
+		{"waiting for the handshake", PeerEntry{Last_seen: now}, 0, activePeerValue},
+		{"ready and active", PeerEntry{Ready: true, Last_seen: now}, 0, readyPeerValue + activePeerValue},
+		{"idle", PeerEntry{Ready: true, Last_seen: now.Add(-peerIdleTime)}, 0, readyPeerValue},
+		{"useful", PeerEntry{Ready: true, Last_seen: now, Useful: 7}, 0, readyPeerValue + activePeerValue + 7},
+		{"usefulness capped", PeerEntry{Ready: true, Last_seen: now, Useful: 1000}, 0, readyPeerValue + activePeerValue + maxUsefulValue},
+		{"misbehaving", PeerEntry{Ready: true, Last_seen: now}, 50, readyPeerValue + activePeerValue - 50/misbehaviorDivisor},
+	}
+
+	for _, test := range tests {
+		if value := peerValue(test.entry, test.score); value != test.want {
+			t.Errorf("%s: value %d, want %d", test.name, value, test.want)
+		}
+	}
+}
+
+func TestNeedPeers(t *testing.T) {
+	resetState(t)
+	config.MinPeers, config.OutboundSlots = 3, 1
+
+	addPeer("inbound-1", true, true, 0)
+	addPeer("inbound-2", true, true, 0)
+	addPeer("inbound-3", true, true, 0)
+	addPeer("outbound-waiting", false, false, 0)
+	if !needPeers() {
+		t.Error("no peers needed without an outbound connection")
+	}
+
+	addPeer("outbound", false, true, 0)
+	if needPeers() {
+		t.Error("peers needed with the outbound slots used and the minimum reached")
+	}
+
+	delete(peerTable, peer.ID("inbound-1").String())
+	delete(peerTable, peer.ID("inbound-2").String())
+	if !needPeers() {
+		t.Error("no peers needed below the minimum")
+	}
+}
+
+func TestUpdatePeerValues(t *testing.T) {
+	resetState(t)
+	config.MinPeers, config.MaxPeers = 2, 4
+
+	manager, err := newConnManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	managed, err := libp2p.New(libp2p.NoListenAddrs, libp2p.ConnectionManager(manager))
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := User
+	User = managed
+	t.Cleanup(func() {
+		User = local
+		managed.Close()
+	})
+
+	// Six inbound peers connected an hour apart, the first four of them sharing a network group
+	start := time.Now().Add(-24 * time.Hour)
+	for idx := 0; idx < 6; idx++ {
+		id := fmt.Sprint("inbound-", idx)
+		peerTable[id] = &PeerEntry{
+			Info:      peer.AddrInfo{ID: peer.ID(id)},
+			Inbound:   true,
+			Ready:     true,
+			Connected: start.Add(time.Duration(idx) * time.Hour),
+			Group:     fmt.Sprint("group-", max(idx-3, 0)),
+			Useful:    idx,
+		}
+	}
+	Peer_Scores[peer.ID("inbound-0").String()] = 10
+
+	updatePeerValues()
+
+	protected := func(tag string) []string {
+		ids := []string{}
+		for idx := 0; idx < 6; idx++ {
+			id := fmt.Sprint("inbound-", idx)
+			if manager.IsProtected(peer.ID(id), tag) {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+
+	// The misbehaving peer is left out, however long it has been connected
+	if got := fmt.Sprint(protected(protectLongLivedTag)); got != "[inbound-1 inbound-2 inbound-3 inbound-4]" {
+		t.Errorf("long lived peers protected: %s", got)
+	}
+
+	// The most useful peer of each of the three groups
+	if got := fmt.Sprint(protected(protectDiverseTag)); got != "[inbound-3 inbound-4 inbound-5]" {
+		t.Errorf("diverse peers protected: %s", got)
+	}
+}
+
+func TestNewConnManager(t *testing.T) {
+	resetState(t)
+	config.MinPeers, config.MaxPeers = 10, 5
+
+	if _, err := newConnManager(); err == nil {
+		t.Error("connection manager with the minimum above the maximum")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Consensus engine - decides who may seal a block and which chain is the best one
+type Consensus interface {
+	// Name of the engine, as selected in the config
+	Name() string
+
+	// Fill in the consensus fields of a new block before it is sealed
+	Prepare(block *Block) error
+
+	// Seal the block so that the other nodes accept it, stopping when the context is cancelled
+	Seal(ctx context.Context, block *Block) error
+
+	// Check the seal of a block received from the network
+	VerifySeal(block Block) error
+
+	// Report whether the chain ending at candidate should replace the chain ending at current
+	ChooseFork(current Block, candidate Block) bool
+}
+
+// Create the consensus engine selected in the config
+func newConsensus(config Config, privKey crypto.PrivKey, self peer.ID) (Consensus, error) {
+	switch config.Consensus {
+	case "pow":
+		if config.Difficulty < 1 || config.Difficulty > 64 {
+			return nil, fmt.Errorf("difficulty must be between 1 and 64, got %d", config.Difficulty)
+		}
+		return &PowEngine{Difficulty: config.Difficulty, Workers: config.MinerThreads}, nil
+
+	case "poa":
+		if len(config.Authorities) == 0 {
+			return nil, fmt.Errorf("proof-of-authority needs at least one --authority")
+		}
+		return &PoaEngine{Authorities: config.Authorities, Key: privKey, Self: self}, nil
+	}
+
+	return nil, fmt.Errorf("unknown consensus engine %q", config.Consensus)
+}
+
+// Proof-of-work engine - the block hash must start with Difficulty zeros
+type PowEngine struct {
+	Difficulty int32
+	Workers    int // Goroutines searching the nonces
+}
+
+func (engine *PowEngine) Name() string {
+	return "pow"
+}
+
+func (engine *PowEngine) Prepare(block *Block) error {
+	block.Difficulty = engine.Difficulty
+	return nil
+}
+
+// Search the nonces until the hash meets the difficulty
+func (engine *PowEngine) Seal(ctx context.Context, block *Block) error {
+	for {
+		found, err := searchNonces(ctx, block, engine.Workers)
+		if err != nil {
+			return fmt.Errorf("mining interrupted")
+		}
+
+		if found {
+			return nil
+		}
+
+		// Every nonce was tried - change the header and start over
+		rollExtraNonce(block)
+	}
+}
+
+func (engine *PowEngine) VerifySeal(block Block) error {
+	// The genesis block is not mined
+	if block.Block_height == 0 {
+		return nil
+	}
+
+	if block.Difficulty != engine.Difficulty {
+		return fmt.Errorf("block difficulty %d does not match the network difficulty %d", block.Difficulty, engine.Difficulty)
+	}
+
+	expected := block
+	expected.generateBlockHash()
+	if expected.Block_hash != block.Block_hash {
+		return fmt.Errorf("block hash does not match its header")
+	}
+
+	if !strings.HasPrefix(block.Block_hash, strings.Repeat("0", int(block.Difficulty))) {
+		return fmt.Errorf("block hash does not meet the difficulty")
+	}
+
+	return nil
+}
+
+// The chain with the most accumulated work wins
+func (engine *PowEngine) ChooseFork(current Block, candidate Block) bool {
+	return chainWork(candidate).Cmp(chainWork(current)) > 0
+}
+
+// Total work of the chain ending at the block - each hex zero of difficulty is 16 times the work
+func chainWork(block Block) *big.Int {
+	BlockMutex.RLock()
+	defer BlockMutex.RUnlock()
+
+	work := big.NewInt(0)
+	for {
+		work.Add(work, new(big.Int).Lsh(big.NewInt(1), uint(4*block.Difficulty)))
+
+		// The synced headers count before their bodies are downloaded
+		previous, exists := Blockchain[block.Previous_hash]
+		if !exists {
+			header, synced := Headers[block.Previous_hash]
+			if !synced {
+				return work
+			}
+			previous = header.toBlock()
+		}
+		block = previous
+	}
+}
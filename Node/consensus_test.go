@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Block on top of the parent, with a coinbase paying the wallet, sealed by the engine
+func makeBlock(t *testing.T, parent Block, txns ...Transaction) Block {
+	t.Helper()
+
+	coinbase := Transaction{
+		Out_sz:    1,
+		Outputs:   []Output{{Pubkey: walletPubkey(), Value: 1}},
+		Timestamp: time.Now(),
+	}
+	coinbase.generateTxn()
+
+	block := Block{
+		Block_height:  parent.Block_height + 1,
+		Previous_hash: parent.Block_hash,
+		Timestamp:     time.Now(),
+		Transactions:  append([]Transaction{coinbase}, txns...),
+	}
+	block.Merkle_hash = buildMerkle(block.Transactions).Value
+
+	if err := Engine.Prepare(&block); err != nil {
+		t.Fatal(err)
+	}
+	if err := Engine.Seal(context.Background(), &block); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func tipBlock() Block {
+	BlockMutex.RLock()
+	defer BlockMutex.RUnlock()
+	return Blockchain[Latest_Block]
+}
+
+func TestNewConsensus(t *testing.T) {
+	key := newKey(t)
+	self, _ := peer.IDFromPrivateKey(key)
+
+	tests := []struct {
+		config Config
+		engine string // Empty when the config is rejected
+	}{
+		{Config{Consensus: "pow", Difficulty: 4}, "pow"},
+		{Config{Consensus: "pow", Difficulty: 0}, ""},
+		{Config{Consensus: "pow", Difficulty: 65}, ""},
+		{Config{Consensus: "poa", Authorities: []peer.ID{self}}, "poa"},
+		{Config{Consensus: "poa"}, ""},
+		{Config{Consensus: "pos"}, ""},
+	}
+
+	for _, test := range tests {
+		engine, err := newConsensus(test.config, key, self)
+		switch {
+		case test.engine == "" && err == nil:
+			t.Errorf("%+v: engine %s created", test.config, engine.Name())
+		case test.engine != "" && err != nil:
+			t.Errorf("%+v: %v", test.config, err)
+		case test.engine != "" && engine.Name() != test.engine:
+			t.Errorf("%+v: engine %s, want %s", test.config, engine.Name(), test.engine)
+		}
+	}
+}
+
+func TestPowSeal(t *testing.T) {
+	engine := &PowEngine{Difficulty: 2}
+	block := Block{Block_height: 1, Previous_hash: "parent", Merkle_hash: "root", Timestamp: time.Now()}
+
+	if err := engine.Prepare(&block); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.Seal(context.Background(), &block); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.VerifySeal(block); err != nil {
+		t.Fatalf("sealed block rejected: %v", err)
+	}
+
+	changed := block
+	changed.Merkle_hash = "other root"
+	if err := engine.VerifySeal(changed); err == nil {
+		t.Error("block changed after sealing accepted")
+	}
+
+	easier := block
+	easier.Difficulty = 1
+	easier.generateBlockHash()
+	if err := engine.VerifySeal(easier); err == nil {
+		t.Error("block below the network difficulty accepted")
+	}
+
+	// A cancelled search gives up
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := (&PowEngine{Difficulty: 64}).Seal(ctx, &block); err == nil {
+		t.Error("cancelled seal succeeded")
+	}
+}
+
+func TestPoaTurns(t *testing.T) {
+	first, second := newKey(t), newKey(t)
+	firstID, _ := peer.IDFromPrivateKey(first)
+	secondID, _ := peer.IDFromPrivateKey(second)
+	authorities := []peer.ID{firstID, secondID}
+
+	engines := map[peer.ID]*PoaEngine{
+		firstID:  {Authorities: authorities, Key: first, Self: firstID},
+		secondID: {Authorities: authorities, Key: second, Self: secondID},
+	}
+
+	for height := int32(1); height <= 4; height++ {
+		block := Block{Block_height: height, Previous_hash: "parent", Timestamp: time.Now()}
+		inTurn := authorities[int(height)%2]
+		outOfTurn := authorities[int(height+1)%2]
+
+		if err := engines[outOfTurn].Prepare(&block); err == nil {
+			t.Fatalf("height %d: authority out of turn prepared the block", height)
+		}
+		if err := engines[inTurn].Prepare(&block); err != nil {
+			t.Fatal(err)
+		}
+		if err := engines[inTurn].Seal(context.Background(), &block); err != nil {
+			t.Fatal(err)
+		}
+		if err := engines[outOfTurn].VerifySeal(block); err != nil {
+			t.Fatalf("height %d: sealed block rejected: %v", height, err)
+		}
+
+		block.Timestamp = block.Timestamp.Add(time.Second)
+		if err := engines[outOfTurn].VerifySeal(block); err == nil {
+			t.Fatalf("height %d: changed block accepted", height)
+		}
+	}
+}
+
+// A longer fork takes over the tip, and the spend only on the old chain goes back to the mempool
+func TestReorganize(t *testing.T) {
+	resetState(t)
+	genesis := tipBlock()
+
+	funding := makeBlock(t, genesis)
+	if _, err := acceptBlock(funding); err != nil {
+		t.Fatal(err)
+	}
+	coinbase := funding.Transactions[0]
+
+	txn := spendOutput(coinbase.Txn_id, walletPubkey(), 0.9, 0.1)
+	if err := signInputs(&txn, Wallet_Key); err != nil {
+		t.Fatal(err)
+	}
+	main := makeBlock(t, funding, txn)
+	if tipChanged, err := acceptBlock(main); err != nil || !tipChanged {
+		t.Fatalf("main chain block: tip changed = %v, err = %v", tipChanged, err)
+	}
+	if _, exists := UTXO_SET[utxoKey(coinbase.Txn_id, 0)]; exists {
+		t.Fatal("spent coinbase output left in the UTXO set")
+	}
+
+	// The first fork block only ties, the second one overtakes the main chain
+	fork := makeBlock(t, funding)
+	if tipChanged, err := acceptBlock(fork); err != nil || tipChanged {
+		t.Fatalf("equal work fork: tip changed = %v, err = %v", tipChanged, err)
+	}
+	longer := makeBlock(t, fork)
+	if tipChanged, err := acceptBlock(longer); err != nil || !tipChanged {
+		t.Fatalf("longer fork: tip changed = %v, err = %v", tipChanged, err)
+	}
+
+	if Latest_Block != longer.Block_hash {
+		t.Error("tip not moved to the longer fork")
+	}
+	if _, exists := Mempool[txn.Txn_id]; !exists {
+		t.Error("transaction of the undone block not returned to the mempool")
+	}
+	if _, exists := UTXO_SET[utxoKey(coinbase.Txn_id, 0)]; !exists {
+		t.Error("output spent by the undone block not restored")
+	}
+	if _, exists := UTXO_SET[utxoKey(main.Transactions[0].Txn_id, 0)]; exists {
+		t.Error("coinbase of the undone block left in the UTXO set")
+	}
+}
+
+func TestCheckBlockSanity(t *testing.T) {
+	resetState(t)
+	block := makeBlock(t, tipBlock(), spendOutput("funding", walletPubkey(), 1, 0))
+
+	tests := []struct {
+		name   string
+		change func(block *Block)
+		valid  bool
+	}{
+		{"valid block", func(block *Block) {}, true},
+		{"merkle root of other transactions", func(block *Block) { block.Transactions = block.Transactions[:1] }, false},
+		{"transaction id not matching", func(block *Block) {
+			block.Transactions[1].Fee = 5
+			block.Merkle_hash = buildMerkle(block.Transactions).Value
+		}, false},
+		{"second coinbase", func(block *Block) {
+			block.Transactions = append(block.Transactions, block.Transactions[0])
+			block.Merkle_hash = buildMerkle(block.Transactions).Value
+		}, false},
+	}
+
+	for _, test := range tests {
+		changed := block
+		changed.Transactions = append([]Transaction{}, block.Transactions...)
+		test.change(&changed)
+		err := checkBlockSanity(changed)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: valid = %v, want %v (%v)", test.name, err == nil, test.valid, err)
+		}
+	}
+}
+
+func TestInvalidForkIsForgotten(t *testing.T) {
+	resetState(t)
+	genesis := tipBlock()
+
+	main := makeBlock(t, genesis)
+	if _, err := acceptBlock(main); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fork overtakes the main chain with a block spending an unknown output
+	fork := makeBlock(t, genesis)
+	invalid := makeBlock(t, fork, spendOutput("unknown", walletPubkey(), 1, 0))
+
+	if tipChanged, err := acceptBlock(fork); err != nil || tipChanged {
+		t.Fatalf("equal work fork: tip changed = %v, err = %v", tipChanged, err)
+	}
+	if _, err := acceptBlock(invalid); err == nil {
+		t.Fatal("invalid fork accepted")
+	}
+
+	if Latest_Block != main.Block_hash {
+		t.Error("tip moved off the main chain")
+	}
+	if _, exists := Blockchain[invalid.Block_hash]; exists {
+		t.Error("invalid fork block kept")
+	}
+	if _, exists := Blockchain[fork.Block_hash]; !exists {
+		t.Error("valid fork block forgotten")
+	}
+
+	// A fork block failing the checks independent of the chain is never stored
+	broken := makeBlock(t, genesis)
+	broken.Merkle_hash = "00"
+	broken.generateBlockHash()
+	if err := Engine.Seal(context.Background(), &broken); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acceptBlock(broken); err == nil {
+		t.Fatal("fork block with a wrong merkle root accepted")
+	}
+	if _, exists := Blockchain[broken.Block_hash]; exists {
+		t.Error("fork block with a wrong merkle root kept")
+	}
+}
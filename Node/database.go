@@ -3,21 +3,24 @@ package main
 import (
 	"context"
 	"sync"
+	"time"
 
 	dht "github.com/libp2p/go-libp2p-kad-dht"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
-	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 // Global variables
 var (
 	// Functional variables
-	User        host.Host                                             // Current User Node
-	config      Config                                                // Configuration
-	peerMutex   sync.RWMutex                                          // Mutex for the message database
-	kademliaDHT *dht.IpfsDHT                                          // Local DHT
-	peerArray   []peer.AddrInfo          = []peer.AddrInfo{}          // Array of neighbors
-	peerSet     map[string]peer.AddrInfo = map[string]peer.AddrInfo{} // Set of neighbors
+	User        host.Host                                       // Current User Node
+	Wallet_Key  crypto.PrivKey                                  // Private key used to sign transactions
+	Engine      Consensus                                       // Consensus engine sealing and verifying blocks
+	config      Config                                          // Configuration
+	peerMutex   sync.RWMutex                                    // Mutex for the peer table and the message database
+	kademliaDHT *dht.IpfsDHT                                    // Local DHT
+	peerTable   map[string]*PeerEntry = map[string]*PeerEntry{} // Connected neighbors, kept up to date by trackPeers
 
 	// Message database
 	m_id     int32                       = 1
@@ -30,8 +33,30 @@ var (
 	Mempool       map[string]Transaction = map[string]Transaction{}
 	UTXO_SET      map[string]UTXO        = map[string]UTXO{}
 	Blockchain    map[string]Block       = map[string]Block{}
+	Block_Heights map[int32]string       = map[int32]string{}       // Height -> hash of the block on the main chain
+	Headers       map[string]BlockHeader = map[string]BlockHeader{} // Validated headers whose blocks are not downloaded yet
 	Merkle_Roots  map[string]*MerkleNode = map[string]*MerkleNode{}
 	Transactions  map[string]Transaction = map[string]Transaction{}
+	Partial_Txns  map[string]Transaction = map[string]Transaction{} // Multisig transactions waiting for co-signers
+	Partial_Times map[string]time.Time   = map[string]time.Time{}   // Arrival of the partial transactions
+
+	Mempool_Spends map[string]string       = map[string]string{}       // UTXO key -> mempool transaction spending it
+	Mempool_Outs   map[string]UTXO         = map[string]UTXO{}         // UTXO key -> output created by a mempool transaction
+	Mempool_Info   map[string]MempoolEntry = map[string]MempoolEntry{} // Arrival time and size of the mempool transactions
+	Mempool_Bytes  int                     = 0                         // Total size of the mempool transactions
+	Mempool_Gen    uint64                  = 0                         // Bumped on every change of the mempool
+	Mempool_Evict  []string                = []string{}                // Mempool transactions by ascending fee rate, the first one is evicted first
+
+	// Misbehavior of the peers
+	Peer_Scores map[string]int       = map[string]int{}       // Misbehavior score of the peers
+	Ban_List    map[string]time.Time = map[string]time.Time{} // Banned peers -> end of the ban
+
+	// Streams of the peers, for the rate limits
+	Stream_Buckets map[streamKey]*streamBucket = map[streamKey]*streamBucket{}
+
+	// Pubsub relay
+	Pubsub        *pubsub.PubSub                                        // GossipSub router of the node
+	Pubsub_Topics map[string]*pubsub.Topic = map[string]*pubsub.Topic{} // Joined topics, by their short name
 
 	// Mutex for the respective Databases
 	MempoolMutex sync.RWMutex // Mutex for the mempool
@@ -39,7 +64,13 @@ var (
 	BlockMutex   sync.RWMutex // Mutex for the blockchain
 	MerkleMutex  sync.RWMutex // Mutex for the Merkle roots
 	TransMutex   sync.RWMutex // Mutex for the transactions
+	PartialMutex sync.RWMutex // Mutex for the partial transactions
+	ChainMutex   sync.Mutex   // Serializes the changes of the chain tip
+	BanMutex     sync.RWMutex // Mutex for the misbehavior scores and the ban list
+	LimitMutex   sync.Mutex   // Mutex for the stream buckets
 
+	miningMutex  sync.Mutex // Mutex for the mining context
 	miningCtx    context.Context
 	miningCancel context.CancelFunc
+	miningDone   chan struct{} // Closed once the mining goroutine returns
 )
@@ -1,86 +1,348 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
 	"fmt"
-	"strconv"
+	"sort"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/network"
 )
 
-// Send the blockchain when the full node starts up
-func downloadBlockchain(rw *bufio.ReadWriter, strm network.Stream) {
+// Most blocks sent for one request
+const maxBlocksPerRequest = 500
 
-	// Read the latest block of the remote peer
-	data, _ := rw.ReadString('\n')
+// Most bytes of blocks sent for one request - a longer range is cut short, and the rest asked for again
+const maxBlockBytesPerRequest = 16 << 20
 
-	remote_block := Block{}
+// Most headers sent for one request
+const maxHeadersPerRequest = 2000
 
-	json.Unmarshal([]byte(data), &remote_block)
+const (
+	bodyWindowSize      = 128              // Blocks requested from one peer at a time during the sync
+	maxBodyAttempts     = 3                // Peers tried for a window before the sync gives up
+	blockRequestTimeout = 30 * time.Second // Time a peer has to answer a block request
+)
+
+// Send the main chain headers following the first block of the peer's locator that is on the main chain
+func downloadHeaders(wire *Wire, strm network.Stream) {
+	defer strm.Close()
 
-	// Check if the remote peer has a longer blockchain
-	if len(Blockchain) < int(remote_block.Block_height) {
-		rw.WriteString("Shorter. Try from others\n")
-		rw.Flush()
+	var locator []string
+	err := wire.Read(msgLocator, &locator)
+	if err != nil {
+		fmt.Println("Failed to read block locator:", err)
 		return
 	}
 
-	// Get the block height of the remote peer
-	remote_height := remote_block.Block_height
+	headers := []BlockHeader{}
+
+	BlockMutex.RLock()
+
+	// Start after the fork point, or from the genesis block when the locator shares nothing
+	height := int32(0)
+	for _, hash := range locator {
+		block, exists := Blockchain[hash]
+		if exists && Block_Heights[block.Block_height] == hash {
+			height = block.Block_height + 1
+			break
+		}
+	}
+
+	for ; len(headers) < maxHeadersPerRequest; height++ {
+		hash, exists := Block_Heights[height]
+		if !exists {
+			break
+		}
+		block := Blockchain[hash]
+		headers = append(headers, block.header())
+	}
+
+	BlockMutex.RUnlock()
+
+	// Send the number of headers, then the headers
+	wire.Write(msgCount, len(headers))
+	for _, header := range headers {
+		wire.Write(msgHeader, header)
+	}
+
+	err = wire.Flush()
+	if err != nil {
+		fmt.Println("Failed to send headers to", strm.Conn().RemotePeer(), err)
+	}
+}
+
+// Send the inventory of the Mempool, then the transactions the peer is missing
+func downloadMempool(wire *Wire, strm network.Stream) {
+	defer strm.Close()
+
+	MempoolMutex.RLock()
+	inventory := make([]string, 0, len(Mempool))
+	for txnID := range Mempool {
+		inventory = append(inventory, txnID)
+	}
+	MempoolMutex.RUnlock()
 
-	// Send the length of the blockchain
-	_, err := rw.WriteString(strconv.Itoa(len(Blockchain)) + "\n")
-	rw.Flush()
+	// Send the IDs of the mempool transactions
+	wire.Write(msgCount, len(inventory))
+	for _, txnID := range inventory {
+		wire.Write(msgID, txnID)
+	}
+	err := wire.Flush()
+	if err != nil {
+		fmt.Println("Failed to send Mempool inventory:", err)
+		return
+	}
+
+	// Read the IDs the peer is missing
+	var count int
+	err = wire.Read(msgCount, &count)
 	if err != nil {
-		fmt.Println("Failed to send blockchain length:", err)
+		fmt.Println("Failed to read the requested transactions:", err)
 		return
 	}
 
-	currentBlock := Blockchain[Latest_Block]
-	// Send the blockchain from the remote peer
-	for i := int(remote_height); i < len(Blockchain); i++ {
-		// Convert to JSON
-		blockJSON, _ := json.Marshal(currentBlock)
-		// Send the block
-		rw.WriteString(string(blockJSON) + "\n")
-		rw.Flush()
-		// Move to the next Block
-		currentBlock = Blockchain[currentBlock.Block_hash]
+	if count < 0 || count > len(inventory) {
+		fmt.Println("Invalid number of requested transactions from", strm.Conn().RemotePeer())
+		return
 	}
 
-	fmt.Println("Blockchain sent to", strm.Conn().RemotePeer())
+	requested := make([]Transaction, 0, count)
+	ancestors := map[string]int{}
+
+	for i := 0; i < count; i++ {
+		var txnID string
+		err := wire.Read(msgID, &txnID)
+		if err != nil {
+			break
+		}
+
+		// The transaction may have been mined or evicted since the inventory was sent
+		MempoolMutex.RLock()
+		txn, exists := Mempool[txnID]
+		if exists {
+			requested = append(requested, txn)
+			ancestors[txn.Txn_id] = len(txnAncestors(txn, Mempool))
+		}
+		MempoolMutex.RUnlock()
+	}
+
+	// Parents go first, so the peer can admit their children
+	sort.Slice(requested, func(i, j int) bool {
+		return ancestors[requested[i].Txn_id] < ancestors[requested[j].Txn_id]
+	})
+
+	// Send the requested transactions
+	wire.Write(msgCount, len(requested))
+	for _, txn := range requested {
+		wire.Write(msgTransaction, txn)
+	}
+	err = wire.Flush()
+	if err != nil {
+		fmt.Println("Failed to send Mempool transactions:", err)
+		return
+	}
+
+	fmt.Printf("Mempool inventory of %d sent to %s, %d transaction(s) requested\n", len(inventory), strm.Conn().RemotePeer(), len(requested))
 }
 
-// Send the Mempool
-func downloadMempool(rw *bufio.ReadWriter, strm network.Stream) {
+// Send the main chain after the latest block of the peer, for the nodes of the previous release.
+// Deprecated: the headers-first sync replaces it, and it is only served for one more release.
+func downloadBlockchain(wire *Wire, strm network.Stream) {
+	defer strm.Close()
 
-	// Send the length of the Mempool
-	_, err := rw.WriteString(strconv.Itoa(len(Mempool)) + "\n")
-	rw.Flush()
+	var latest string
+	err := wire.Read(msgID, &latest)
 	if err != nil {
-		fmt.Println("Failed to send Mempool length:", err)
+		fmt.Println("Failed to read latest block:", err)
 		return
 	}
 
-	// Send the Mempool
-	for _, txn := range Mempool {
-		// Convert to JSON
-		txnJSON, _ := json.Marshal(txn)
-		// Send the transaction
-		rw.WriteString(string(txnJSON) + "\n")
-		rw.Flush()
+	blocks := []Block{}
+
+	BlockMutex.RLock()
+
+	// Start after the block of the peer, or after the genesis block when it is not on the main chain
+	height := int32(1)
+	if block, exists := Blockchain[latest]; exists && Block_Heights[block.Block_height] == latest {
+		height = block.Block_height + 1
 	}
 
-	fmt.Println("Mempool sent to", strm.Conn().RemotePeer())
+	for ; len(blocks) < maxBlocksPerRequest; height++ {
+		hash, exists := Block_Heights[height]
+		if !exists {
+			break
+		}
+		blocks = append(blocks, Blockchain[hash])
+	}
+
+	BlockMutex.RUnlock()
+
+	blocks = limitBlocks(blocks, maxBlockBytesPerRequest)
+
+	if len(blocks) == 0 {
+		wire.Write(msgText, "Shorter. Try from others")
+		wire.Flush()
+		return
+	}
+
+	// Send the number of blocks, then the blocks
+	wire.Write(msgCount, len(blocks))
+	for _, block := range blocks {
+		wire.Write(msgBlock, block)
+	}
+
+	err = wire.Flush()
+	if err != nil {
+		fmt.Println("Failed to send blockchain to", strm.Conn().RemotePeer(), err)
+	}
 }
 
-// Send a block
-func downloadBlock(rw *bufio.ReadWriter, strm network.Stream) {
+// Send a block by hash, or a range of main chain blocks, answering notfound when there is none
+func downloadBlock(wire *Wire, strm network.Stream) {
+	defer strm.Close()
 
+	var request BlockRequest
+	err := wire.Read(msgBlockRequest, &request)
+	if err != nil {
+		fmt.Println("Failed to read block request:", err)
+		return
+	}
+
+	count := min(max(request.Count, 1), maxBlocksPerRequest)
+	blocks := []Block{}
+	height := request.Height
+
+	BlockMutex.RLock()
+	if request.Hash != "" {
+		block, exists := Blockchain[request.Hash]
+		if exists {
+			blocks = append(blocks, block)
+			height = block.Block_height + 1
+
+			// A range only continues along the main chain
+			if Block_Heights[block.Block_height] != block.Block_hash {
+				count = 1
+			}
+		}
+	}
+
+	if request.Hash == "" || len(blocks) > 0 {
+		for int32(len(blocks)) < count {
+			hash, exists := Block_Heights[height]
+			if !exists {
+				break
+			}
+			blocks = append(blocks, Blockchain[hash])
+			height++
+		}
+	}
+	BlockMutex.RUnlock()
+
+	blocks = limitBlocks(blocks, maxBlockBytesPerRequest)
+
+	if len(blocks) == 0 {
+		wire.Write(msgNotFound, nil)
+		wire.Flush()
+		return
+	}
+
+	// Send the number of blocks, then the blocks
+	wire.Write(msgCount, len(blocks))
+	for _, block := range blocks {
+		wire.Write(msgBlock, block)
+	}
+
+	err = wire.Flush()
+	if err != nil {
+		fmt.Println("Failed to send blocks to", strm.Conn().RemotePeer(), err)
+	}
+}
+
+// Cut a range of blocks down to the byte limit, keeping the first block whatever its size
+func limitBlocks(blocks []Block, maxBytes int) []Block {
+	size := 0
+	for idx, block := range blocks {
+		size += blockSize(block)
+		if idx > 0 && size > maxBytes {
+			return blocks[:idx]
+		}
+	}
+	return blocks
+}
+
+// Send a transaction, with the proof of its inclusion in a block once confirmed
+func downloadTransaction(wire *Wire, strm network.Stream) {
+	defer strm.Close()
+
+	var txnID string
+	err := wire.Read(msgID, &txnID)
+	if err != nil {
+		return
+	}
+
+	proof, found := transactionProof(txnID)
+	if !found {
+		wire.Write(msgNotFound, nil)
+		wire.Flush()
+		return
+	}
+
+	wire.Write(msgProof, proof)
+
+	err = wire.Flush()
+	if err != nil {
+		fmt.Println("Failed to send transaction to", strm.Conn().RemotePeer(), err)
+	}
 }
 
-// Send a transaction
-func downloadTransaction(rw *bufio.ReadWriter, strm network.Stream) {
+// Look a transaction up in the chain, with its merkle branch, or in the mempool
+func transactionProof(txnID string) (TransactionProof, bool) {
+	TransMutex.RLock()
+	txn, confirmed := Transactions[txnID]
+	TransMutex.RUnlock()
+
+	if !confirmed {
+		MempoolMutex.RLock()
+		txn, exists := Mempool[txnID]
+		MempoolMutex.RUnlock()
+
+		return TransactionProof{Transaction: txn}, exists
+	}
+
+	BlockMutex.RLock()
+	block, exists := Blockchain[txn.Block_hash]
+	BlockMutex.RUnlock()
+
+	if !exists {
+		return TransactionProof{}, false
+	}
+
+	index := -1
+	for idx, blockTxn := range block.Transactions {
+		if blockTxn.Txn_id == txnID {
+			index = idx
+			break
+		}
+	}
+	if index < 0 {
+		return TransactionProof{}, false
+	}
+
+	// Use the stored merkle tree of the block, rebuilding it if it is missing
+	MerkleMutex.RLock()
+	root, exists := Merkle_Roots[block.Merkle_hash]
+	MerkleMutex.RUnlock()
+
+	if !exists {
+		root = buildMerkle(block.Transactions)
+	}
 
+	return TransactionProof{
+		Transaction:  txn,
+		Confirmed:    true,
+		Block_hash:   block.Block_hash,
+		Block_height: block.Block_height,
+		Index:        index,
+		Branch:       merkleBranch(root, index, len(block.Transactions)),
+	}, true
 }
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// A second host on the loopback, connected to the node's host
+func remoteHost(t *testing.T) host.Host {
+	t.Helper()
+
+	remote, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		remote.Close()
+
+		// The node forgets the peer before the next test resets its state
+		waitPeer(t, remote.ID(), false)
+	})
+
+	if err := User.Connect(context.Background(), peer.AddrInfo{ID: remote.ID(), Addrs: remote.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	return remote
+}
+
+// Serve a node protocol of the remote host in every wire version
+func serveWire(remote host.Host, path string, handler network.StreamHandler) {
+	for _, id := range wireProtocols(path) {
+		remote.SetStreamHandler(id, handler)
+	}
+}
+
+// Read a count followed by as many messages of the type
+func readList[T any](wire *Wire, msgType byte) ([]T, error) {
+	var count int
+	if err := wire.Read(msgCount, &count); err != nil {
+		return nil, err
+	}
+
+	list := make([]T, count)
+	for i := range list {
+		if err := wire.Read(msgType, &list[i]); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+func TestDownloadMempool(t *testing.T) {
+	resetState(t)
+	remote := remoteHost(t)
+	serveWire(remote, "/download/mempool", exportMempool)
+
+	parent := mempoolTxn("parent", 0.01, 0)
+	child := mempoolTxn("child", 0.01, 0, parent.Txn_id)
+	mempoolTxn("known", 0.01, 0)
+
+	stream, wire, err := openStream(context.Background(), remote.ID(), "/download/mempool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	if wire.Version != wireFramed {
+		t.Errorf("wire version %d negotiated, want %d", wire.Version, wireFramed)
+	}
+	if inventory, _ := readList[string](wire, msgID); len(inventory) != 3 {
+		t.Fatalf("inventory %v, want the three mempool transactions", inventory)
+	}
+
+	// The child is asked for before its parent, and one transaction left the mempool meanwhile
+	wire.Write(msgCount, 3)
+	for _, txnID := range []string{"child", "parent", "gone"} {
+		wire.Write(msgID, txnID)
+	}
+	wire.Flush()
+
+	txns, err := readList[Transaction](wire, msgTransaction)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := []string{}
+	for _, txn := range txns {
+		sent = append(sent, txn.Txn_id)
+	}
+
+	if fmt.Sprint(sent) != fmt.Sprint([]string{parent.Txn_id, child.Txn_id}) {
+		t.Errorf("sent %v, want the parent before the child", sent)
+	}
+}
+
+func TestUpdateMempool(t *testing.T) {
+	resetState(t)
+	remote := remoteHost(t)
+
+	mempoolTxn("pending", 0.01, 0)
+	Transactions["mined"] = Transaction{Txn_id: "mined"}
+	fresh := fundedSpend(t, "funding", 0.01)
+
+	// An older peer, speaking only the legacy wire, offering a pending, a mined and a new transaction
+	requested := make(chan []string, 1)
+	remote.SetStreamHandler("/test/download/mempool", func(stream network.Stream) {
+		defer stream.Close()
+		wire := newWire(stream)
+
+		wire.Write(msgCount, 3)
+		for _, txnID := range []string{"pending", "mined", fresh.Txn_id} {
+			wire.Write(msgID, txnID)
+		}
+		wire.Flush()
+
+		ids, _ := readList[string](wire, msgID)
+		requested <- ids
+
+		wire.Write(msgCount, 1)
+		wire.Write(msgTransaction, fresh)
+		wire.Flush()
+	})
+
+	if err := updateMempool(peer.AddrInfo{ID: remote.ID()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := <-requested; fmt.Sprint(got) != fmt.Sprint([]string{fresh.Txn_id}) {
+		t.Errorf("requested %v, want only the unseen transaction", got)
+	}
+	if _, exists := Mempool[fresh.Txn_id]; !exists {
+		t.Error("fetched transaction not admitted to the mempool")
+	}
+}
+
+func TestDownloadBlock(t *testing.T) {
+	resetState(t)
+	remote := remoteHost(t)
+	serveWire(remote, "/download/block", exportBlock)
+
+	// Main chain genesis, first, second and a fork off the genesis
+	chain := []Block{tipBlock()}
+	for len(chain) < 3 {
+		block := makeBlock(t, chain[len(chain)-1])
+		if _, err := acceptBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		chain = append(chain, block)
+	}
+	fork := makeBlock(t, chain[0])
+	if _, err := acceptBlock(fork); err != nil {
+		t.Fatal(err)
+	}
+
+	hashes := func(blocks []Block) string {
+		ids := []string{}
+		for _, block := range blocks {
+			ids = append(ids, block.Block_hash)
+		}
+		return fmt.Sprint(ids)
+	}
+
+	block, err := fetchBlock(remote.ID(), chain[1].Block_hash)
+	if err != nil || block.Block_hash != chain[1].Block_hash {
+		t.Errorf("fetched %s, %v, want %s", block.Block_hash, err, chain[1].Block_hash)
+	}
+
+	blocks, err := requestBlocks(remote.ID(), BlockRequest{Height: 1, Count: 10})
+	if err != nil || hashes(blocks) != hashes(chain[1:]) {
+		t.Errorf("range from height 1 %s, %v, want the main chain %s", hashes(blocks), err, hashes(chain[1:]))
+	}
+
+	// A range from a fork block stops at the block
+	blocks, err = requestBlocks(remote.ID(), BlockRequest{Hash: fork.Block_hash, Count: 10})
+	if err != nil || hashes(blocks) != hashes([]Block{fork}) {
+		t.Errorf("range from a fork block %s, %v, want the fork block alone", hashes(blocks), err)
+	}
+
+	for name, request := range map[string]BlockRequest{"unknown hash": {Hash: "unknown"}, "height past the tip": {Height: 3}} {
+		if _, err := requestBlocks(remote.ID(), request); err == nil {
+			t.Errorf("%s answered", name)
+		}
+	}
+}
+
+// A node of the previous release downloads the chain after its latest block
+func TestDownloadBlockchain(t *testing.T) {
+	resetState(t)
+	remote := remoteHost(t)
+	legacy := protocol.ID(config.ProtocolID + "/download/blockchain")
+	remote.SetStreamHandler(legacy, exportBlockchain)
+
+	chain := []Block{tipBlock()}
+	for len(chain) < 4 {
+		block := makeBlock(t, chain[len(chain)-1])
+		if _, err := acceptBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		chain = append(chain, block)
+	}
+
+	download := func(latest string) ([]Block, string) {
+		stream, err := User.NewStream(context.Background(), remote.ID(), legacy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stream.Close()
+
+		wire := newWire(stream)
+		wire.Write(msgID, latest)
+		wire.Flush()
+
+		line, err := wire.readRawLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var count int
+		if _, err := fmt.Sscan(line, &count); err != nil {
+			return nil, strings.TrimSpace(line)
+		}
+
+		blocks := make([]Block, count)
+		for idx := range blocks {
+			if err := wire.Read(msgBlock, &blocks[idx]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return blocks, ""
+	}
+
+	tests := []struct {
+		name   string
+		latest string
+		want   []Block
+	}{
+		{"behind", chain[1].Block_hash, chain[2:]},
+		{"unknown block", "unknown", chain[1:]},
+	}
+
+	for _, test := range tests {
+		blocks, _ := download(test.latest)
+		if len(blocks) != len(test.want) {
+			t.Errorf("%s: %d blocks sent, want %d", test.name, len(blocks), len(test.want))
+			continue
+		}
+		for idx, block := range blocks {
+			if block.Block_hash != test.want[idx].Block_hash {
+				t.Errorf("%s: block %d is %s, want %s", test.name, idx, block.Block_hash, test.want[idx].Block_hash)
+			}
+		}
+	}
+
+	if _, answer := download(chain[3].Block_hash); answer != "Shorter. Try from others" {
+		t.Errorf("answer %q to a peer at the tip", answer)
+	}
+}
+
+func TestLimitBlocks(t *testing.T) {
+	block := Block{Transactions: []Transaction{{Txn_id: "coinbase"}}}
+	size := blockSize(block)
+
+	tests := []struct {
+		name     string
+		blocks   int
+		maxBytes int
+		want     int
+	}{
+		{"under the limit", 3, 3 * size, 3},
+		{"over the limit", 3, 2*size + 1, 2},
+		{"first block over the limit", 2, size - 1, 1},
+		{"no blocks", 0, size, 0},
+	}
+
+	for _, test := range tests {
+		blocks := make([]Block, test.blocks)
+		for idx := range blocks {
+			blocks[idx] = block
+		}
+		if got := len(limitBlocks(blocks, test.maxBytes)); got != test.want {
+			t.Errorf("%s: %d blocks kept, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFetchTransaction(t *testing.T) {
+	resetState(t)
+	remote := remoteHost(t)
+	serveWire(remote, "/download/transaction", exportTransaction)
+
+	spend := fundedSpend(t, "funding", 0.01)
+	block := makeBlock(t, tipBlock(), spend)
+	if _, err := acceptBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	pending := fundedSpend(t, "pending", 0.01)
+	if err := acceptToMempool(pending); err != nil {
+		t.Fatal(err)
+	}
+
+	proof, err := fetchTransaction(remote.ID(), spend.Txn_id)
+	if err != nil || !proof.Confirmed || proof.Block_hash != block.Block_hash || proof.Index != 1 {
+		t.Errorf("confirmed transaction fetched as %+v, %v", proof, err)
+	}
+
+	proof, err = fetchTransaction(remote.ID(), pending.Txn_id)
+	if err != nil || proof.Confirmed {
+		t.Errorf("mempool transaction fetched as confirmed %v, %v", proof.Confirmed, err)
+	}
+
+	if _, err := fetchTransaction(remote.ID(), "unknown"); err == nil {
+		t.Error("unknown transaction fetched")
+	}
+
+	// A peer claiming the transaction sits elsewhere in the block
+	serveWire(remote, "/download/transaction", func(stream network.Stream) {
+		defer stream.Close()
+		wire := newWire(stream)
+		var txnID string
+		wire.Read(msgID, &txnID)
+
+		forged, _ := transactionProof(txnID)
+		forged.Index = 0
+		wire.Write(msgProof, forged)
+		wire.Flush()
+	})
+	if _, err := fetchTransaction(remote.ID(), spend.Txn_id); err == nil {
+		t.Error("forged inclusion proof accepted")
+	}
+}
+
+func TestDownloadHeaders(t *testing.T) {
+	resetState(t)
+	remote := remoteHost(t)
+	serveWire(remote, "/download/headers", exportHeaders)
+
+	chain := []Block{tipBlock()}
+	for len(chain) < 4 {
+		block := makeBlock(t, chain[len(chain)-1])
+		if _, err := acceptBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		chain = append(chain, block)
+	}
+	fork := makeBlock(t, chain[1])
+	if _, err := acceptBlock(fork); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		locator []string
+		from    int32
+	}{
+		{"locator at the tip", []string{chain[3].Block_hash, chain[2].Block_hash}, 4},
+		{"locator behind the tip", []string{chain[1].Block_hash, chain[0].Block_hash}, 2},
+		{"fork block skipped", []string{fork.Block_hash, chain[0].Block_hash}, 1},
+		{"nothing shared", []string{"unknown"}, 0},
+	}
+
+	for _, test := range tests {
+		headers, err := requestHeaders(remote.ID(), test.locator)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		got := []string{}
+		for _, header := range headers {
+			got = append(got, header.Block_hash)
+		}
+		want := []string{}
+		for _, block := range chain[test.from:] {
+			want = append(want, block.Block_hash)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: headers %v, want the main chain from height %d", test.name, got, test.from)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+const (
+	maxConfirmTarget = 25      // Longest confirmation target tracked, in blocks
+	minBucketRate    = 0.00001 // Fee rate of the lowest bucket
+	maxBucketRate    = 100.0   // Fee rate above which all transactions share the top bucket
+	bucketSpacing    = 1.1     // Ratio between the fee rates of neighbouring buckets
+	feeStatsDecay    = 0.998   // Weight left to the older confirmations at every block
+	confirmThreshold = 0.85    // Share of transactions that must confirm within the target
+	minBucketSamples = 10.0    // Decayed transactions needed to judge a group of buckets
+)
+
+var (
+	estimatorMutex  sync.Mutex
+	feeBuckets      = newFeeBuckets()                                    // Lowest fee rate of each bucket, ascending
+	bucketTotal     = make([]float64, len(feeBuckets))                   // Confirmed transactions per bucket
+	bucketConfirmed = newConfirmStats(maxConfirmTarget, len(feeBuckets)) // [target-1][bucket] transactions confirmed within the target
+)
+
+func newFeeBuckets() []float64 {
+	buckets := []float64{}
+	for rate := minBucketRate; rate < maxBucketRate; rate *= bucketSpacing {
+		buckets = append(buckets, rate)
+	}
+	return buckets
+}
+
+func newConfirmStats(targets int, buckets int) [][]float64 {
+	stats := make([][]float64, targets)
+	for idx := range stats {
+		stats[idx] = make([]float64, buckets)
+	}
+	return stats
+}
+
+// Bucket holding the fee rate
+func bucketIndex(rate float64) int {
+	idx := sort.SearchFloat64s(feeBuckets, rate)
+	if idx == len(feeBuckets) || feeBuckets[idx] > rate {
+		idx--
+	}
+	return max(idx, 0)
+}
+
+// Record how many blocks the mempool transactions confirmed in a block waited
+func recordConfirmations(height int32, confirmed []MempoolEntry) {
+	estimatorMutex.Lock()
+	defer estimatorMutex.Unlock()
+
+	// Older blocks count less
+	for bucket := range feeBuckets {
+		bucketTotal[bucket] *= feeStatsDecay
+		for target := range bucketConfirmed {
+			bucketConfirmed[target][bucket] *= feeStatsDecay
+		}
+	}
+
+	for _, entry := range confirmed {
+		blocks := max(int(height-entry.Height)+1, 1)
+		bucket := bucketIndex(entry.Fee_rate)
+
+		bucketTotal[bucket]++
+		for target := blocks; target <= maxConfirmTarget; target++ {
+			bucketConfirmed[target-1][bucket]++
+		}
+	}
+}
+
+// Fee rate per kilobyte for a transaction to confirm within the target number of blocks.
+// Falls back to the configured fee until enough blocks have been seen.
+func estimateFee(target int) float64 {
+	target = min(max(target, 1), maxConfirmTarget)
+	height := nextBlockHeight()
+
+	// Mempool transactions already waiting longer than the target count as failures
+	failed := make([]float64, len(feeBuckets))
+	MempoolMutex.RLock()
+	for _, entry := range Mempool_Info {
+		if int(height-entry.Height) >= target {
+			failed[bucketIndex(entry.Fee_rate)]++
+		}
+	}
+	MempoolMutex.RUnlock()
+
+	estimatorMutex.Lock()
+
+	// Walk down from the highest fee rate, grouping buckets until they have enough transactions,
+	// while the groups keep confirming in time
+	passing := -1
+	groupConfirmed, groupTotal := 0.0, 0.0
+	for bucket := len(feeBuckets) - 1; bucket >= 0; bucket-- {
+		groupConfirmed += bucketConfirmed[target-1][bucket]
+		groupTotal += bucketTotal[bucket] + failed[bucket]
+
+		if groupTotal < minBucketSamples {
+			continue
+		}
+
+		if groupConfirmed/groupTotal < confirmThreshold {
+			break
+		}
+
+		passing = bucket
+		groupConfirmed, groupTotal = 0, 0
+	}
+
+	estimatorMutex.Unlock()
+
+	minFee := mempoolMinFee()
+	if passing < 0 {
+		return math.Max(config.FallbackFee, minFee)
+	}
+
+	return math.Max(feeBuckets[passing], minFee)
+}
+
+// Size of the transaction with every signature at the longest DER length (72 bytes in hex),
+// as a signature over the rebuilt transaction may come out longer
+func signedSize(txn Transaction) int {
+	size := txnSize(txn)
+	for _, input := range txn.Inputs {
+		for _, signature := range append([]string{input.Signature}, input.Signatures...) {
+			if signature != "" {
+				size += max(144-len(signature), 0)
+			}
+		}
+	}
+	return size
+}
+
+// Fee for the transaction at the fee rate, rounded up to the smallest unit
+func feeForSize(rate float64, size int) float64 {
+	return math.Ceil(rate*float64(size)/1000*1e8) / 1e8
+}
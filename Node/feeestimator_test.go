@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Blocks each confirming a transaction paying 0.01 per kB at once and one paying 0.0005 after five blocks
+func recordBlocks(count int32) {
+	for height := int32(10); height < 10+count; height++ {
+		recordConfirmations(height, []MempoolEntry{
+			{Fee_rate: 0.01, Height: height},
+			{Fee_rate: 0.0005, Height: height - 4},
+		})
+	}
+}
+
+func TestEstimateFee(t *testing.T) {
+	resetState(t)
+
+	if rate := estimateFee(1); rate != config.FallbackFee {
+		t.Errorf("estimate %.8f without confirmations, want the fallback %.8f", rate, config.FallbackFee)
+	}
+
+	// Too few confirmations to judge the buckets
+	recordBlocks(int32(minBucketSamples) - 1)
+	if rate := estimateFee(1); rate != config.FallbackFee {
+		t.Errorf("estimate %.8f from %d confirmations, want the fallback %.8f", rate, int(minBucketSamples)-1, config.FallbackFee)
+	}
+
+	recordBlocks(30)
+
+	fast, slow := feeBuckets[bucketIndex(0.01)], feeBuckets[bucketIndex(0.0005)]
+	if rate := estimateFee(1); rate != fast {
+		t.Errorf("estimate %.8f to confirm in the next block, want %.8f", rate, fast)
+	}
+	if rate := estimateFee(5); rate != slow {
+		t.Errorf("estimate %.8f to confirm within five blocks, want %.8f", rate, slow)
+	}
+
+	// Transactions of the slow bucket stuck in the mempool count against it
+	for idx := 0; idx < 10; idx++ {
+		Mempool_Info[fmt.Sprint("stuck", idx)] = MempoolEntry{Fee_rate: 0.0005, Height: -10}
+	}
+	if rate := estimateFee(5); rate != fast {
+		t.Errorf("estimate %.8f with the slow bucket stuck, want %.8f", rate, fast)
+	}
+
+	// Never below what the mempool admits
+	rollingMinFee, rollingFeeUpdated = 1, time.Now()
+	if rate := estimateFee(5); rate < 0.99 {
+		t.Errorf("estimate %.8f below the mempool minimum of about 1", rate)
+	}
+}
+
+func TestSendFundsEstimatesFee(t *testing.T) {
+	resetState(t)
+	UTXO_SET[utxoKey("funding", 0)] = UTXO{Txn_id: "funding", Value: 1, Pubkey: walletPubkey()}
+
+	// Without peers the transaction only reaches the mempool
+	sendFunds([]string{utxoKey("funding", 0)}, []Output{{Pubkey: pubkeyHex(newKey(t)), Value: 0.5}}, 0, true, 0)
+	if len(Mempool) != 1 {
+		t.Fatalf("%d transactions in the mempool, want the one sent", len(Mempool))
+	}
+
+	var txn Transaction
+	for _, txn = range Mempool {
+	}
+	// Signatures vary in length, so the fee covers the final size with a few bytes to spare at most
+	want := feeForSize(config.FallbackFee, txnSize(txn))
+	if txn.Fee < want || txn.Fee > feeForSize(config.FallbackFee, txnSize(txn)+20) {
+		t.Errorf("fee %.8f for %d bytes, want %.8f", txn.Fee, txnSize(txn), want)
+	}
+	if change := txn.Outputs[1].Value; change != 0.5-txn.Fee {
+		t.Errorf("change %.8f, want %.8f", change, 0.5-txn.Fee)
+	}
+}
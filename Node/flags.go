@@ -2,9 +2,12 @@ package main
 
 import (
 	"flag"
+	"runtime"
 	"strings"
+	"time"
 
 	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/peer"
 	maddr "github.com/multiformats/go-multiaddr"
 )
 
@@ -30,6 +33,28 @@ func (addrList *AddrList) Set(value string) error {
 	return nil
 }
 
+type PeerList []peer.ID
+
+// Join all the peer IDs in the list into a single string separated by commas
+func (peerList *PeerList) String() string {
+	strs := make([]string, len(*peerList))
+	for i, id := range *peerList {
+		strs[i] = id.String()
+	}
+
+	return strings.Join(strs, ",")
+}
+
+// Decode a peer ID and append to the peerList
+func (peerList *PeerList) Set(value string) error {
+	id, err := peer.Decode(value)
+	if err != nil {
+		return err
+	}
+	*peerList = append(*peerList, id)
+	return nil
+}
+
 // Provide an array of multi address Strings
 func StringsToAddrs(addrString []string) (maddrs []maddr.Multiaddr, err error) {
 	for _, addrString := range addrString {
@@ -47,6 +72,29 @@ type Config struct {
 	BootstrapPeers   AddrList
 	ListenAddresses  AddrList
 	ProtocolID       string
+	Consensus        string        // Consensus engine: pow or poa
+	Difficulty       int32         // Leading hex zeros of a proof-of-work block hash
+	Authorities      PeerList      // Sealers of a proof-of-authority chain, in turn order
+	MinerThreads     int           // Goroutines searching the proof-of-work nonces
+	Mine             bool          // Keep mining blocks built from the mempool
+	MaxBlockTxns     int           // Most transactions in a mined block, besides the coinbase
+	MaxBlockSize     int           // Most bytes of transactions in a mined block
+	MinerAddress     string        // Hex public key paid by the coinbase of the mined blocks
+	WorkListen       string        // Address serving mining work to external miners
+	MinRelayFee      float64       // Lowest fee per kilobyte admitted to the mempool
+	RBFIncrement     float64       // Fee per kilobyte a replacement must add over the transactions it replaces
+	MaxMempool       int           // Most bytes of transactions kept in the mempool
+	MempoolExpiry    time.Duration // Age after which an unconfirmed transaction is dropped
+	MaxAncestors     int           // Most unconfirmed transactions in a mempool chain, the transaction included
+	MaxAncestorSize  int           // Most bytes of a mempool transaction and its unconfirmed ancestors
+	ConfTarget       int           // Blocks the estimated fee of a sent transaction aims to confirm within
+	FallbackFee      float64       // Fee per kilobyte estimated before enough blocks have been seen
+	BanScore         int           // Misbehavior score at which a peer is banned
+	BanTime          time.Duration // Time a misbehaving peer stays banned
+	BanFile          string        // File the ban list is persisted to
+	MinPeers         int           // Peers below which the node looks for more, and down to which it trims
+	MaxPeers         int           // Peers above which the lowest value connections are trimmed
+	OutboundSlots    int           // Connections the node opens itself, more are opened while it is below the minimum peers
 }
 
 func ParseFlags() (Config, error) {
@@ -57,8 +105,35 @@ func ParseFlags() (Config, error) {
 	flag.Var(&config.BootstrapPeers, "peer", "Adds a peer multiaddress to the bootstrap list")
 	flag.Var(&config.ListenAddresses, "listen", "Adds a multiaddress to the listen list")
 	flag.StringVar(&config.ProtocolID, "pid", "/blockchain/1.0.0", "Sets a protocol id for stream headers")
+	flag.StringVar(&config.Consensus, "consensus", "pow", "Consensus engine: pow (proof-of-work) or poa (proof-of-authority)")
+	difficulty := flag.Int("difficulty", 4, "Leading hex zeros required in a proof-of-work block hash")
+	flag.Var(&config.Authorities, "authority", "Adds a peer ID to the proof-of-authority sealers, in turn order")
+	flag.IntVar(&config.MinerThreads, "miner-threads", runtime.NumCPU(), "Number of goroutines mining in parallel")
+	flag.BoolVar(&config.Mine, "mine", false, "Continuously mine blocks built from the best paying mempool transactions")
+	flag.IntVar(&config.MaxBlockTxns, "max-block-txns", 1000, "Most transactions in a mined block")
+	flag.IntVar(&config.MaxBlockSize, "max-block-size", 1000000, "Most bytes of transactions in a mined block")
+	flag.StringVar(&config.MinerAddress, "miner-address", "", "Hex public key that receives the mining rewards (defaults to the wallet key)")
+	flag.Float64Var(&config.MinRelayFee, "min-relay-fee", 0.0001, "Lowest fee per kilobyte a transaction needs to enter the mempool")
+	flag.Float64Var(&config.RBFIncrement, "rbf-increment", 0.0001, "Fee per kilobyte a replacement must pay over the transactions it replaces")
+	maxMempool := flag.Int("max-mempool", 300, "Most megabytes of transactions kept in the mempool")
+	flag.DurationVar(&config.MempoolExpiry, "mempool-expiry", 336*time.Hour, "Drops the mempool transactions older than this")
+	flag.IntVar(&config.MaxAncestors, "max-ancestors", 25, "Most unconfirmed transactions in a mempool chain")
+	maxAncestorSize := flag.Int("max-ancestor-size", 101, "Most kilobytes of a mempool transaction with its unconfirmed ancestors")
+	flag.IntVar(&config.ConfTarget, "conf-target", 6, "Blocks the estimated fee aims to confirm a sent transaction within")
+	flag.Float64Var(&config.FallbackFee, "fallback-fee", 0.001, "Fee per kilobyte used until the node has seen enough blocks to estimate")
+	flag.IntVar(&config.BanScore, "ban-score", 100, "Misbehavior score at which a peer is disconnected and banned")
+	flag.DurationVar(&config.BanTime, "ban-time", 24*time.Hour, "Time a misbehaving peer stays banned")
+	flag.StringVar(&config.BanFile, "ban-file", "banlist.json", "File the ban list is kept in")
+	flag.IntVar(&config.MinPeers, "min-peers", 8, "Peers below which more are looked for, and down to which the connections are trimmed")
+	flag.IntVar(&config.MaxPeers, "max-peers", 32, "Peers above which the lowest value connections are trimmed")
+	flag.IntVar(&config.OutboundSlots, "outbound-slots", 8, "Connections the node opens to the peers it discovers")
+	flag.StringVar(&config.WorkListen, "work-listen", "", "Serves mining work to external miners on this address, e.g. 127.0.0.1:8545")
 	flag.Parse()
 
+	config.Difficulty = int32(*difficulty)
+	config.MaxMempool = *maxMempool * 1000000
+	config.MaxAncestorSize = *maxAncestorSize * 1000
+
 	if len(config.BootstrapPeers) == 0 {
 		config.BootstrapPeers = dht.DefaultBootstrapPeers
 	}
@@ -1,20 +1,16 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 	"math/rand"
-	"strconv"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/peer"
-	"github.com/libp2p/go-libp2p/core/protocol"
 )
 
 // Creation of a merkle tree and storage
@@ -68,167 +64,260 @@ func merkleFunc(txnList []Transaction, treeIdx int, level int, depth int) *Merkl
 	return node
 }
 
-// Sending UTXOs - Create the transaction and add it to the mempool
-func sendFunds(utxo []string, nodeID []string, amount []float64, fee float64) (string, error) {
+// Collect the siblings on the path from the leaf of the transaction at the index up to the root
+func merkleBranch(root *MerkleNode, index int, count int) []string {
+	depth := int(math.Ceil(math.Log2(float64(count))))
+	branch := make([]string, depth)
+
+	node := root
+	for level := 0; level < depth; level++ {
+		// The bits of the index pick the path from the root, the highest bit first
+		if index>>(depth-1-level)&1 == 1 {
+			branch[depth-1-level] = node.Left.Value
+			node = node.Right
+		} else {
+			branch[depth-1-level] = node.Right.Value
+			node = node.Left
+		}
+	}
+
+	return branch
+}
+
+// Check the branch leads from the transaction at the index to the merkle root
+func verifyMerkleBranch(txnID string, index int, branch []string, root string) bool {
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(txnID)))
+
+	for level, sibling := range branch {
+		if index>>level&1 == 1 {
+			hash = fmt.Sprintf("%x", sha256.Sum256([]byte(sibling+hash)))
+		} else {
+			hash = fmt.Sprintf("%x", sha256.Sum256([]byte(hash+sibling)))
+		}
+	}
+
+	return hash == root
+}
+
+// Sending UTXOs - Create the transaction and add it to the mempool. The fee is estimated when asked, instead of the given one.
+func sendFunds(utxo []string, outputs []Output, fee float64, estimate bool, lockTime int64) (string, error) {
 
 	inputs := make([]Input, len(utxo))
-	outputs := make([]Output, len(nodeID))
 
 	// Create inputs of the transaction
 	inputSum := 0.0
 	for idx, utxoHash := range utxo {
 
-		UTXOMutex.RLock()
-		utxoInput := UTXO_SET[utxoHash]
-		UTXOMutex.RUnlock()
+		// Unconfirmed outputs of the mempool can be spent too
+		utxoInput, exists := findUTXOByKey(utxoHash)
+
+		if !exists {
+			return "", fmt.Errorf("utxo %s does not exist", utxoHash)
+		}
+
+		// Only the outputs the wallet holds a key for can be signed for
+		if !canSign(utxoInput, walletPubkey()) {
+			return "", fmt.Errorf("utxo %s is not owned by this wallet", utxoHash)
+		}
 
 		inputs[idx] = Input{
 			Txn_id: utxoInput.Txn_id,
-			Index:  int32(utxoInput.Value),
+			Index:  utxoInput.Index,
 		}
 		inputSum += utxoInput.Value
 	}
 
-	// Create outputs of the transaction
+	// Check the outputs of the transaction
 	outputSum := 0.0
-	for idx, key := range nodeID {
-		outputs[idx] = Output{
-			Pubkey: key,
-			Value:  amount[idx],
+	for _, output := range outputs {
+		if err := validateOutput(output); err != nil {
+			return "", err
 		}
-		outputSum += amount[idx]
-	}
-
-	if outputSum+fee > inputSum {
-		return "", fmt.Errorf("output sum and fee is greater than the input")
-	}
-
-	// Create another output for the change
-	if inputSum-outputSum-fee > 0 {
-		outputs = append(outputs, Output{
-			Pubkey: User.ID().String(),
-			Value:  inputSum - outputSum - fee,
-		})
-	}
-
-	// Create the transaction
-	transaction := &Transaction{
-		In_sz:     int32(len(inputs)),
-		Out_sz:    int32(len(outputs)),
-		Fee:       fee,
-		Inputs:    inputs,
-		Outputs:   outputs,
-		Timestamp: time.Now(),
+		outputSum += output.Value
 	}
 
-	transaction.generateTxn()
-
-	// Obtain the peers available
-	peerMutex.RLock()
-	peers := peerArray
-	peerMutex.RUnlock()
+	// Build and sign the transaction paying the fee
+	build := func(fee float64) (*Transaction, error) {
+		if outputSum+fee > inputSum {
+			return nil, fmt.Errorf("output sum and fee is greater than the input")
+		}
 
-	success := false
+		txnOutputs := append([]Output{}, outputs...)
 
-	// Broadcast the transactions to the peers
-	for _, peer := range peers {
-		stream, err := User.NewStream(
-			context.Background(),
-			peer.ID,
-			protocol.ID(config.ProtocolID+"/broadcast/transaction"),
-		)
+		// Create another output for the change
+		if inputSum-outputSum-fee > 0 {
+			txnOutputs = append(txnOutputs, Output{
+				Pubkey: walletPubkey(),
+				Value:  inputSum - outputSum - fee,
+			})
+		}
 
-		if err != nil {
-			fmt.Println("Failed to create a stream:", err)
-			continue
+		// Create the transaction
+		transaction := &Transaction{
+			In_sz:     int32(len(inputs)),
+			Out_sz:    int32(len(txnOutputs)),
+			Fee:       fee,
+			Inputs:    append([]Input{}, inputs...),
+			Outputs:   txnOutputs,
+			Timestamp: time.Now(),
+			Lock_time: lockTime,
 		}
 
-		rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+		transaction.generateTxn()
 
-		data, err := json.Marshal(transaction)
+		// Sign every input with the wallet key
+		err := signInputs(transaction, Wallet_Key)
 		if err != nil {
-			fmt.Println("Failed to serialize message:", err)
-			stream.Close()
-			continue
+			return nil, err
 		}
 
-		_, err = rw.WriteString(string(data) + "\n")
+		return transaction, nil
+	}
+
+	if !estimate {
+		transaction, err := build(fee)
 		if err != nil {
-			fmt.Println("Failed to send message to peer:", peer.ID, err)
-			stream.Close()
-			continue
+			return "", err
 		}
+		return broadcastFunds(transaction)
+	}
 
-		// Flush the buffer to ensure data is sent
-		err = rw.Flush()
-		if err != nil {
-			fmt.Println("Failed to flush data to peer:", peer.ID, err)
-			stream.Close()
-			continue
+	// Estimate the fee, rebuilding until it covers the size of the signed transaction
+	rate := estimateFee(config.ConfTarget)
+	transaction, err := build(0)
+	for attempt := 0; err == nil && attempt < 3; attempt++ {
+		fee = feeForSize(rate, signedSize(*transaction))
+		if attempt > 0 && transaction.Fee >= fee {
+			break
 		}
-		stream.Close()
-		success = true
+		transaction, err = build(fee)
+	}
+	if err != nil {
+		return "", err
 	}
 
-	if !success {
-		return "", fmt.Errorf("failed to communicate with any peers")
+	fmt.Printf("Estimated fee: %.8f (%.8f per kB to confirm within %d blocks)\n", transaction.Fee, rate, config.ConfTarget)
+	return broadcastFunds(transaction)
+}
+
+// Broadcast a transaction made by the wallet, or keep it for the co-signers
+func broadcastFunds(transaction *Transaction) (string, error) {
+
+	// Multisig inputs wait for the co-signers before being broadcast
+	if missing := missingSignatures(transaction); missing > 0 {
+		PartialMutex.Lock()
+		expirePartialTxns(time.Now())
+		storePartialTxn(*transaction)
+		PartialMutex.Unlock()
+
+		fmt.Printf("Transaction %s needs %d more signature(s) from co-signers\n", transaction.Txn_id, missing)
+		return transaction.Txn_id, nil
 	}
 
-	// Add the transaction to the mempool
-	MempoolMutex.Lock()
-	if _, exists := Mempool[transaction.Txn_id]; !exists {
-		Mempool[transaction.Txn_id] = *transaction
+	err := submitTransaction(transaction)
+	if err != nil {
+		return "", err
 	}
-	MempoolMutex.Unlock()
 
 	return transaction.Txn_id, nil
 }
 
+// Add a fully signed transaction to the mempool and broadcast it
+func submitTransaction(transaction *Transaction) error {
+
+	// Only the transactions the mempool accepts are broadcast
+	err := acceptToMempool(*transaction)
+	if err != nil {
+		return err
+	}
+
+	notifyNewTxn(*transaction)
+
+	// Broadcast the transactions to the peers - the transaction stays pending in the mempool either way
+	if relayTransaction(*transaction) == 0 {
+		fmt.Println("Warning: transaction", transaction.Txn_id, "is in the mempool, but no peer could be reached to relay it")
+	}
+
+	return nil
+}
+
 // Remove the confirmed transactions from the mempool - typically called after mining a block
 func removeFromMempool(block Block) {
 	if len(block.Transactions) == 0 {
 		return
 	}
 
+	confirmed := []MempoolEntry{}
 	for _, txn := range block.Transactions {
 		// Add the transaction to Transaction database
+		txn.Block_hash = block.Block_hash
 		TransMutex.Lock()
 		Transactions[txn.Txn_id] = txn
 		TransMutex.Unlock()
 
-		// Handle the UTXOs, creating and destorying the UTXOs
-		go handleUTXO(&txn)
+		// Handle the UTXOs, creating and destorying the UTXOs - in order, as later transactions may spend earlier ones
+		handleUTXO(&txn, block.Block_height)
 
-		// Remove the transaction from the mempool
+		// Remove the transaction, and the ones double spending its inputs with their descendants, from the mempool
 		MempoolMutex.Lock()
-		delete(Mempool, txn.Txn_id)
+		if entry, exists := Mempool_Info[txn.Txn_id]; exists {
+			confirmed = append(confirmed, entry)
+		}
+		deleteMempool(txn.Txn_id)
+		for _, input := range txn.Inputs {
+			if spender, exists := Mempool_Spends[utxoKey(input.Txn_id, input.Index)]; exists {
+				for _, descendant := range mempoolDescendants(spender) {
+					deleteMempool(descendant)
+				}
+				deleteMempool(spender)
+			}
+		}
 		MempoolMutex.Unlock()
 	}
+
+	// Learn how long the mempool transactions took to confirm
+	recordConfirmations(block.Block_height, confirmed)
 }
 
 // Add and Remove UTXOs
-func handleUTXO(txn *Transaction) {
+func handleUTXO(txn *Transaction, height int32) {
 
 	// Destory the UTXOs
 	for _, input := range txn.Inputs {
-		utxoHashInput := sha256.Sum256([]byte(fmt.Sprintf("%s:%d", input.Txn_id, input.Index)))
-
 		UTXOMutex.Lock()
-		delete(UTXO_SET, hex.EncodeToString(utxoHashInput[:]))
+		delete(UTXO_SET, utxoKey(input.Txn_id, input.Index))
 		UTXOMutex.Unlock()
 	}
 
 	// Create the UTXOS
 	for idx, output := range txn.Outputs {
 		// Add the new UTXO into the UTXO set
-		utxoHashOutput := sha256.Sum256([]byte(fmt.Sprintf("%s:%d", txn.Txn_id, idx)))
-
 		UTXOMutex.Lock()
-		UTXO_SET[hex.EncodeToString(utxoHashOutput[:])] = UTXO{txn.Txn_id, int32(idx), output.Value, output.Pubkey}
+		UTXO_SET[utxoKey(txn.Txn_id, int32(idx))] = newUTXO(txn.Txn_id, int32(idx), output, height)
 		UTXOMutex.Unlock()
 	}
 }
 
+// Make the UTXO for an output confirmed at the given height
+func newUTXO(txnID string, index int32, output Output, height int32) UTXO {
+	return UTXO{
+		Txn_id:   txnID,
+		Index:    index,
+		Value:    output.Value,
+		Pubkey:   output.Pubkey,
+		Pubkeys:  output.Pubkeys,
+		Required: output.Required,
+
+		Height:      height,
+		Lock_blocks: output.Lock_blocks,
+	}
+}
+
+// The coinbase is the transaction without inputs that pays the miner
+func isCoinbase(txn Transaction) bool {
+	return len(txn.Inputs) == 0
+}
+
 // Display Mempool
 func displayMempool() {
 	MempoolMutex.RLock()
@@ -255,169 +344,564 @@ func displayBlockchain() {
 	BlockMutex.RUnlock()
 }
 
-// Update the Mempool
+// Update the Mempool from a peer, fetching only the transactions missing from the local inventory
 func updateMempool(peer peer.AddrInfo) error {
 
-	stream, err := User.NewStream(context.Background(), peer.ID, protocol.ID(config.ProtocolID+"/download/mempool"))
+	stream, wire, err := openStream(context.Background(), peer.ID, "/download/mempool")
 	if err != nil {
 		return fmt.Errorf("failed to create stream with peer: %s", peer.String())
 	}
+	defer stream.Close()
 
-	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	// Recieve the inventory of the peer's mempool
+	var inventoryLength int
+	err = wire.Read(msgCount, &inventoryLength)
+	if err != nil || inventoryLength < 0 {
+		return fmt.Errorf("invalid mempool inventory length")
+	}
 
-	// Recieve the length of the mempool
-	mempoolLength, _ := rw.ReadString('\n')
-	mempoolLength = strings.TrimSpace(mempoolLength)
-	mempoolLengthInt, _ := strconv.Atoi(mempoolLength)
+	// Keep the IDs of the transactions not seen yet
+	missing := []string{}
+	for i := 0; i < inventoryLength; i++ {
+		var txnID string
+		err := wire.Read(msgID, &txnID)
+		if err != nil {
+			return fmt.Errorf("failed to read the mempool inventory: %v", err)
+		}
 
-	for i := 0; i < mempoolLengthInt; i++ {
-		// Read the transaction from the peer
-		txnData, _ := rw.ReadString('\n')
+		MempoolMutex.RLock()
+		_, pending := Mempool[txnID]
+		MempoolMutex.RUnlock()
+
+		TransMutex.RLock()
+		_, confirmed := Transactions[txnID]
+		TransMutex.RUnlock()
+
+		if !pending && !confirmed {
+			missing = append(missing, txnID)
+		}
+	}
 
-		// Save them to the mempool
+	// Ask for the missing transactions only
+	wire.Write(msgCount, len(missing))
+	for _, txnID := range missing {
+		wire.Write(msgID, txnID)
+	}
+	err = wire.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to request the missing transactions: %v", err)
+	}
+
+	var txnsLength int
+	err = wire.Read(msgCount, &txnsLength)
+	if err != nil {
+		return fmt.Errorf("failed to read the requested transactions: %v", err)
+	}
+
+	for i := 0; i < txnsLength; i++ {
+		// Read the transaction from the peer
 		var txn Transaction
-		err = json.Unmarshal([]byte(txnData), &txn)
+		err := wire.Read(msgTransaction, &txn)
 		if err != nil {
-			fmt.Println("Failed to parse transaction data:", err)
-			continue
+			return fmt.Errorf("failed to read the requested transactions: %v", err)
 		}
 
 		// Add the transaction to the mempool
-		MempoolMutex.Lock()
-		Mempool[txn.Txn_id] = txn
-		MempoolMutex.Unlock()
+		err = acceptToMempool(txn)
+		if err != nil {
+			if !isDuplicate(err) {
+				fmt.Println("Rejected transaction", txn.Txn_id+":", err)
+			}
+			penalizeRejection(peer.ID, err)
+			continue
+		}
+
+		notifyNewTxn(txn)
+	}
+
+	return nil
+}
+
+// Check a downloaded block is consistent with its own hash and merkle root
+func checkBlockData(block Block) error {
+	expected := block
+	expected.generateBlockHash()
+	if expected.Block_hash != block.Block_hash {
+		return fmt.Errorf("block %s does not match its hash", block.Block_hash)
+	}
+
+	if buildMerkle(block.Transactions).Value != block.Merkle_hash {
+		return fmt.Errorf("block %s does not match its merkle root", block.Block_hash)
 	}
 
 	return nil
 }
 
-// Sync blockchain
+// Request blocks from a peer, checking every block received matches its hash and merkle root
+func requestBlocks(peerID peer.ID, request BlockRequest) ([]Block, error) {
+	stream, wire, err := openStream(context.Background(), peerID, "/download/block")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stream with peer: %s", peerID)
+	}
+	defer stream.Close()
+
+	// A slow peer is given up on, so the request can be retried elsewhere
+	stream.SetDeadline(time.Now().Add(blockRequestTimeout))
+
+	wire.Write(msgBlockRequest, request)
+	err = wire.Flush()
+	if err != nil {
+		return nil, fmt.Errorf("failed to send block request: %v", err)
+	}
+
+	var count int
+	err = wire.Read(msgCount, &count)
+	if err == errNotFound {
+		return nil, fmt.Errorf("block not found on peer %s", peerID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read block response: %v", err)
+	}
+
+	if count < 1 || count > maxBlocksPerRequest {
+		return nil, fmt.Errorf("invalid block response from peer %s", peerID)
+	}
+
+	blocks := make([]Block, 0, count)
+	for i := 0; i < count; i++ {
+		var block Block
+		err := wire.Read(msgBlock, &block)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read block: %v", err)
+		}
+
+		err = checkBlockData(block)
+		if err != nil {
+			return nil, err
+		}
+
+		// A range has to be a chain
+		if i > 0 && (block.Previous_hash != blocks[i-1].Block_hash || block.Block_height != blocks[i-1].Block_height+1) {
+			return nil, fmt.Errorf("blocks from peer %s do not form a chain", peerID)
+		}
+
+		blocks = append(blocks, block)
+	}
+
+	return blocks, nil
+}
+
+// Fetch the full block with the hash from a peer
+func fetchBlock(peerID peer.ID, hash string) (Block, error) {
+	blocks, err := requestBlocks(peerID, BlockRequest{Hash: hash, Count: 1})
+	if err != nil {
+		return Block{}, err
+	}
+
+	if blocks[0].Block_hash != hash {
+		return Block{}, fmt.Errorf("peer %s sent block %s instead of %s", peerID, blocks[0].Block_hash, hash)
+	}
+
+	return blocks[0], nil
+}
+
+// Fetch a transaction from a peer, checking the inclusion proof against the local block header when confirmed
+func fetchTransaction(peerID peer.ID, txnID string) (TransactionProof, error) {
+	var proof TransactionProof
+
+	stream, wire, err := openStream(context.Background(), peerID, "/download/transaction")
+	if err != nil {
+		return proof, fmt.Errorf("failed to create stream with peer: %s", peerID)
+	}
+	defer stream.Close()
+
+	wire.Write(msgID, txnID)
+	err = wire.Flush()
+	if err != nil {
+		return proof, fmt.Errorf("failed to send transaction request: %v", err)
+	}
+
+	err = wire.Read(msgProof, &proof)
+	if err == errNotFound {
+		return proof, fmt.Errorf("transaction not found on peer %s", peerID)
+	}
+	if err != nil {
+		return proof, fmt.Errorf("failed to read transaction response: %v", err)
+	}
+
+	// The ID must commit to the contents
+	expected := proof.Transaction
+	expected.generateTxn()
+	if proof.Transaction.Txn_id != txnID || expected.Txn_id != txnID {
+		return proof, fmt.Errorf("peer %s sent a transaction not matching %s", peerID, txnID)
+	}
+
+	if !proof.Confirmed {
+		return proof, nil
+	}
+
+	BlockMutex.RLock()
+	header, exists := Blockchain[proof.Block_hash]
+	BlockMutex.RUnlock()
+
+	if !exists {
+		return proof, fmt.Errorf("transaction is in block %s, which is not known locally", proof.Block_hash)
+	}
+
+	if header.Block_height != proof.Block_height || !verifyMerkleBranch(txnID, proof.Index, proof.Branch, header.Merkle_hash) {
+		return proof, fmt.Errorf("invalid inclusion proof for transaction %s", txnID)
+	}
+
+	return proof, nil
+}
+
+// Sync blockchain - the headers first, then the bodies of the best header chain
 func syncBlockchain(randomPeer peer.AddrInfo) error {
 	// Update the Mempool
 	go updateMempool(randomPeer)
 
-	// Communicate with remote peer to obtain the new blocks
-	blocks, err := getBlockchain(randomPeer)
+	// Download and check the header chain of the peer
+	headers, err := getHeaders(randomPeer.ID)
 	if err != nil {
-		fmt.Println("Failed to update blockchain:", err)
+		fmt.Println("Failed to download headers:", err)
 		return err
 	}
 
-	// Create the blockchain with the received blocks
-	err = createBlockchain(blocks)
+	if len(headers) == 0 {
+		fmt.Println("Blockchain is up to date")
+		return nil
+	}
+
+	// Only a header chain better than the local chain is worth the bodies
+	BlockMutex.RLock()
+	tip := Blockchain[Latest_Block]
+	BlockMutex.RUnlock()
+
+	if !Engine.ChooseFork(tip, headers[len(headers)-1].toBlock()) {
+		forgetHeaders(headers)
+		fmt.Println("Peer has no better chain. Try from others")
+		return nil
+	}
+
+	// Download the bodies from the connected peers, starting with the one that sent the headers
+	peers := []peer.ID{randomPeer.ID}
+	for _, neighbor := range connectedPeers() {
+		if neighbor.ID != randomPeer.ID {
+			peers = append(peers, neighbor.ID)
+		}
+	}
+
+	err = getBodies(headers, peers)
 	if err != nil {
-		fmt.Println("Failed to create blockchain:", err)
+		forgetHeaders(headers)
+		fmt.Println("Failed to download blocks:", err)
 		return err
 	}
+
+	fmt.Printf("Synced %d block(s) from %s\n", len(headers), randomPeer.ID)
 	return nil
 }
 
-// Update the Blockchain
-func getBlockchain(peer peer.AddrInfo) ([]Block, error) {
+// Hashes of the main chain to find the fork point with a peer - the latest ten blocks,
+// then exponentially further apart, ending at the genesis block
+func blockLocator() []string {
+	BlockMutex.RLock()
+	defer BlockMutex.RUnlock()
 
-	stream, err := User.NewStream(context.Background(), peer.ID, protocol.ID(config.ProtocolID+"/download/blockchain"))
+	locator := []string{}
+	step := int32(1)
+	for height := Blockchain[Latest_Block].Block_height; height > 0; height -= step {
+		locator = append(locator, Block_Heights[height])
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
 
+	return append(locator, Genesis_Block)
+}
+
+// Request the headers following the locator from a peer
+func requestHeaders(peerID peer.ID, locator []string) ([]BlockHeader, error) {
+	stream, wire, err := openStream(context.Background(), peerID, "/download/headers")
 	if err != nil {
-		fmt.Println("Failed to create stream with peer:", peer.String())
-		return nil, err
+		return nil, fmt.Errorf("failed to create stream with peer: %s", peerID)
 	}
+	defer stream.Close()
 
-	// Create a buffered reader writer for the stream
-	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	wire.Write(msgLocator, locator)
+	err = wire.Flush()
+	if err != nil {
+		return nil, fmt.Errorf("failed to send block locator: %v", err)
+	}
 
-	// Send the latest block height
-	_, err = rw.WriteString(Latest_Block + "\n")
+	var count int
+	err = wire.Read(msgCount, &count)
 	if err != nil {
-		fmt.Println("Failed to send latest block height to peer:",
-			stream.Conn().RemotePeer().String(),
-			err,
-		)
-		stream.Close()
-		return nil, err
+		return nil, fmt.Errorf("failed to read headers: %v", err)
 	}
 
-	height_gap, _ := rw.ReadString('\n')
+	if count < 0 || count > maxHeadersPerRequest {
+		return nil, fmt.Errorf("invalid headers response from peer %s", peerID)
+	}
 
-	if height_gap == "Shorter. Try from others\n" {
-		fmt.Println("Peer has a shorter blockchain. Try from others")
-		stream.Close()
-		return nil, fmt.Errorf("peer has a shorter blockchain")
+	headers := make([]BlockHeader, 0, count)
+	for i := 0; i < count; i++ {
+		var header BlockHeader
+		err := wire.Read(msgHeader, &header)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read headers: %v", err)
+		}
+
+		headers = append(headers, header)
 	}
 
-	height_gap = strings.TrimSpace(height_gap)
-	height_gap_int, _ := strconv.Atoi(height_gap)
+	return headers, nil
+}
 
-	blocks := make([]Block, height_gap_int)
+// Download the header chain of a peer beyond the local chain, checking the seal and the linkage of every header.
+// The valid headers are kept in Headers until their bodies arrive.
+func getHeaders(peerID peer.ID) ([]BlockHeader, error) {
+	locator := blockLocator()
+	headers := []BlockHeader{}
 
-	// Receive the blockchain from the peer
-	for i := 0; i < height_gap_int; i++ {
-		// Read the block from the peer
-		blockData, _ := rw.ReadString('\n')
+	for {
+		batch, err := requestHeaders(peerID, locator)
+		if err != nil {
+			forgetHeaders(headers)
+			return nil, err
+		}
+		more := len(batch) == maxHeadersPerRequest
 
-		// Save them to the blockchain
-		var block Block
-		err = json.Unmarshal([]byte(blockData), &block)
+		// A peer sharing nothing with the locator starts over from its genesis block
+		if len(batch) > 0 && batch[0].Block_height == 0 {
+			if batch[0].Block_hash != Genesis_Block {
+				forgetHeaders(headers)
+				return nil, fmt.Errorf("peer %s is on a different genesis block", peerID)
+			}
+			batch = batch[1:]
+		}
+
+		err = validateHeaders(batch)
 		if err != nil {
-			fmt.Println("Failed to parse block data:", err)
-			continue
+			forgetHeaders(headers)
+			misbehaving(peerID, penaltyInvalidBlock, "invalid headers: "+err.Error())
+			return nil, fmt.Errorf("invalid headers from peer %s: %v", peerID, err)
 		}
 
-		// Add it to the blocks slice
-		blocks = append(blocks, block)
-	}
+		// Blocks already stored locally need no bodies
+		for _, header := range batch {
+			BlockMutex.RLock()
+			_, exists := Blockchain[header.Block_hash]
+			BlockMutex.RUnlock()
+
+			if !exists {
+				headers = append(headers, header)
+			}
+		}
 
-	// Close the stream
-	stream.Close()
+		if !more || len(batch) == 0 {
+			return headers, nil
+		}
 
-	return blocks, nil
+		// Continue after the last header received
+		locator = []string{batch[len(batch)-1].Block_hash}
+	}
 }
 
-// Add the new blocks to the existing blockchain
-func createBlockchain(blockchain []Block) error {
+// Check every header links to its parent and carries a valid seal, then index the headers
+func validateHeaders(headers []BlockHeader) error {
+	for idx, header := range headers {
+		var parent BlockHeader
+		if idx > 0 {
+			parent = headers[idx-1]
+		} else {
+			BlockMutex.RLock()
+			block, exists := Blockchain[header.Previous_hash]
+			if exists {
+				parent = block.header()
+			} else {
+				parent, exists = Headers[header.Previous_hash]
+			}
+			BlockMutex.RUnlock()
 
-	// Note: We assume that the []Block is sorted in the order of the blockchain
-	// Last one is the earliest block
+			if !exists {
+				return fmt.Errorf("header %s does not connect to a known block", header.Block_hash)
+			}
+		}
 
-	// Populate the blockchain database
-	for _, block := range blockchain {
-		// Ignore the block making for genesis block
-		if block.Block_height == 0 {
-			continue
+		if header.Previous_hash != parent.Block_hash || header.Block_height != parent.Block_height+1 {
+			return fmt.Errorf("header %s does not link to its parent", header.Block_hash)
 		}
 
-		BlockMutex.Lock()
-		Blockchain[block.Block_hash] = block
-		BlockMutex.Unlock()
+		// The seal (proof-of-work or the authority's signature) commits to the header
+		err := Engine.VerifySeal(header.toBlock())
+		if err != nil {
+			return fmt.Errorf("header %s: %v", header.Block_hash, err)
+		}
+	}
 
-		// Handle the UTXOs, creating and destorying the UTXOs for the new blocks
-		for _, txn := range block.Transactions {
-			go handleUTXO(&txn)
-			TransMutex.Lock()
-			Transactions[txn.Txn_id] = txn
-			TransMutex.Unlock()
+	BlockMutex.Lock()
+	for _, header := range headers {
+		if _, exists := Blockchain[header.Block_hash]; !exists {
+			Headers[header.Block_hash] = header
 		}
+	}
+	BlockMutex.Unlock()
 
-		// No need to assign the result as the merkle root is already sent from the target node
-		MerkleRoot := buildMerkle(block.Transactions)
+	return nil
+}
+
+// Forget the synced headers whose bodies were not downloaded, so that a failed sync leaves none behind
+func forgetHeaders(headers []BlockHeader) {
+	BlockMutex.Lock()
+	for _, header := range headers {
+		delete(Headers, header.Block_hash)
+	}
+	BlockMutex.Unlock()
+}
 
-		// Save the merkle root to the database
-		MerkleMutex.RLock()
-		Merkle_Roots[MerkleRoot.Value] = MerkleRoot
-		MerkleMutex.RUnlock()
+// Window of blocks requested from one peer at a time during the sync
+type bodyWindow struct {
+	index    int
+	headers  []BlockHeader
+	attempts int
+}
+
+// Blocks of a window, or the error that made the window give up
+type bodyResult struct {
+	index  int
+	blocks []Block
+	err    error
+}
+
+// Download the bodies of the headers in parallel windows from the peers, and add the blocks strictly in height order.
+// A peer failing a request is dropped, and its window is retried on the other peers.
+func getBodies(headers []BlockHeader, peers []peer.ID) error {
+	windows := []*bodyWindow{}
+	for start := 0; start < len(headers); start += bodyWindowSize {
+		end := min(start+bodyWindowSize, len(headers))
+		windows = append(windows, &bodyWindow{index: len(windows), headers: headers[start:end]})
 	}
 
-	// Set the genesis block if applicable
-	if blockchain[len(blockchain)-1].Block_height == 0 {
-		Genesis_Block = blockchain[0].Block_hash
+	queue := make(chan *bodyWindow, len(windows))
+	results := make(chan bodyResult, len(windows))
+	for _, window := range windows {
+		queue <- window
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, peerID := range peers {
+		wg.Add(1)
+		go func(peerID peer.ID) {
+			defer wg.Done()
+
+			for {
+				var window *bodyWindow
+				select {
+				case <-ctx.Done():
+					return
+				case window = <-queue:
+				}
+
+				blocks, err := fetchWindow(peerID, window.headers)
+				if err == nil {
+					results <- bodyResult{index: window.index, blocks: blocks}
+					continue
+				}
+
+				fmt.Println("Failed to download blocks:", err)
+
+				window.attempts++
+				if window.attempts >= maxBodyAttempts {
+					results <- bodyResult{index: window.index, err: err}
+				} else {
+					queue <- window
+				}
+				return
+			}
+		}(peerID)
+	}
+
+	// No results are left once every peer has failed
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Connect the windows in order as they arrive
+	pending := map[int][]Block{}
+	for next := 0; next < len(windows); {
+		result, ok := <-results
+		if !ok {
+			return fmt.Errorf("no peers left to download block %d", windows[next].headers[0].Block_height)
+		}
+
+		if result.err != nil {
+			return result.err
+		}
+		pending[result.index] = result.blocks
+
+		for blocks, ready := pending[next]; ready; blocks, ready = pending[next] {
+			for _, block := range blocks {
+				_, err := acceptBlock(block)
+				if err != nil {
+					return fmt.Errorf("block %s: %v", block.Block_hash, err)
+				}
+
+				BlockMutex.Lock()
+				delete(Headers, block.Block_hash)
+				BlockMutex.Unlock()
+			}
+
+			delete(pending, next)
+			next++
+		}
 	}
 
-	// Set the latest block
-	Latest_Block = blockchain[len(blockchain)-1].Block_hash
 	return nil
 }
 
+// Fetch the bodies of a window of consecutive headers from a peer, asking again while it sends part of the window
+func fetchWindow(peerID peer.ID, headers []BlockHeader) ([]Block, error) {
+	blocks := make([]Block, 0, len(headers))
+	for len(blocks) < len(headers) {
+		rest := headers[len(blocks):]
+		fetched, err := requestBlocks(peerID, BlockRequest{Hash: rest[0].Block_hash, Count: int32(len(rest))})
+		if err != nil {
+			return nil, err
+		}
+
+		if len(fetched) > len(rest) {
+			return nil, fmt.Errorf("peer %s sent %d blocks, %d were requested", peerID, len(fetched), len(rest))
+		}
+
+		// Every body has to be the one of the synced header
+		for idx, block := range fetched {
+			if block.Block_hash != rest[idx].Block_hash {
+				return nil, fmt.Errorf("peer %s sent block %s instead of %s", peerID, block.Block_hash, rest[idx].Block_hash)
+			}
+		}
+
+		blocks = append(blocks, fetched...)
+	}
+
+	return blocks, nil
+}
+
+// Height of the block that would extend the current chain
+func nextBlockHeight() int32 {
+	BlockMutex.RLock()
+	defer BlockMutex.RUnlock()
+
+	return Blockchain[Latest_Block].Block_height + 1
+}
+
 func createBlock(transaction []string, coinbaseFee float64) (Block, error) {
 	current_block := Blockchain[Latest_Block]
+	blockTime := time.Now()
 
 	transactions := make([]Transaction, len(transaction)+1)
 
@@ -429,7 +913,7 @@ func createBlock(transaction []string, coinbaseFee float64) (Block, error) {
 		Inputs: []Input{},
 		Outputs: []Output{
 			{
-				Pubkey: User.ID().String(),
+				Pubkey: config.MinerAddress,
 				Value:  coinbaseFee,
 			},
 		},
@@ -440,10 +924,23 @@ func createBlock(transaction []string, coinbaseFee float64) (Block, error) {
 	transactions[0].generateTxn()
 
 	// The include the rest of the transactions
+	view := newUTXOView()
 	for idx, txn := range transaction {
 		MempoolMutex.RLock()
-		transactions[idx+1] = Mempool[txn]
+		mempoolTxn, exists := Mempool[txn]
 		MempoolMutex.RUnlock()
+
+		if !exists {
+			return Block{}, fmt.Errorf("transaction %s is not in the mempool", txn)
+		}
+		transactions[idx+1] = mempoolTxn
+
+		// Only final transactions can be mined
+		err := checkLocks(transactions[idx+1], current_block.Block_height+1, blockTime, view)
+		if err != nil {
+			return Block{}, fmt.Errorf("transaction %s is not final: %v", txn, err)
+		}
+		view.apply(transactions[idx+1], current_block.Block_height+1)
 	}
 
 	// Create a new block
@@ -451,7 +948,7 @@ func createBlock(transaction []string, coinbaseFee float64) (Block, error) {
 		Block_height:  current_block.Block_height + 1,
 		Previous_hash: current_block.Block_hash,
 		Transactions:  transactions,
-		Timestamp:     time.Now(),
+		Timestamp:     blockTime,
 	}
 
 	// Add the block hash to all the transactions
@@ -465,20 +962,90 @@ func createBlock(transaction []string, coinbaseFee float64) (Block, error) {
 	return newBlock, nil
 }
 
-// Validate the transaction by checking the UTXO set
-func validateTransaction(txn Transaction) error {
+// Validate the value and the locking keys of an output
+func validateOutput(output Output) error {
+	if output.Value < 0 {
+		return fmt.Errorf("output value is negative")
+	}
+
+	if output.Lock_blocks < 0 {
+		return fmt.Errorf("output relative lock is negative")
+	}
+
+	// Single key output
+	if output.Required == 0 {
+		if len(output.Pubkeys) > 0 {
+			return fmt.Errorf("multisig output without the required signature count")
+		}
+
+		if _, err := parsePubkey(output.Pubkey); err != nil {
+			return fmt.Errorf("invalid output key %s: %v", output.Pubkey, err)
+		}
+		return nil
+	}
+
+	// Multisig output
+	if output.Pubkey != "" {
+		return fmt.Errorf("multisig output must not set a single key")
+	}
+
+	if output.Required < 0 || int(output.Required) > len(output.Pubkeys) {
+		return fmt.Errorf("multisig output requires %d of %d keys", output.Required, len(output.Pubkeys))
+	}
+
+	seen := map[string]bool{}
+	for _, key := range output.Pubkeys {
+		if seen[key] {
+			return fmt.Errorf("duplicate multisig key %s", key)
+		}
+		seen[key] = true
+
+		if _, err := parsePubkey(key); err != nil {
+			return fmt.Errorf("invalid multisig key %s: %v", key, err)
+		}
+	}
+
+	return nil
+}
+
+// Input that is not an unspent output - not seen yet, or already spent
+var errMissingInput = errors.New("input does not exist in the UTXO set")
+
+// Validate the transaction by checking the UTXO set, for a block at the given height and time
+func validateTransaction(txn Transaction, height int32, blockTime time.Time, view *UTXOView) error {
+
+	// The ID must commit to the contents of the transaction
+	expected := txn
+	expected.generateTxn()
+	if expected.Txn_id != txn.Txn_id {
+		return fmt.Errorf("transaction id does not match its contents")
+	}
+
+	// Check the lock time and the relative locks
+	err := checkLocks(txn, height, blockTime, view)
+	if err != nil {
+		return err
+	}
 
 	// Check the availablity in the UTXO Set
 	inputSum := 0.0
+	seen := map[string]bool{}
 	for _, input := range txn.Inputs {
-		utxoHash := sha256.Sum256([]byte(fmt.Sprintf("%s:%d", input.Txn_id, input.Index)))
-
-		UTXOMutex.RLock()
-		utxo, exists := UTXO_SET[hex.EncodeToString(utxoHash[:])]
-		UTXOMutex.RUnlock()
+		key := utxoKey(input.Txn_id, input.Index)
+		if seen[key] {
+			return fmt.Errorf("input %s:%d is spent twice", input.Txn_id, input.Index)
+		}
+		seen[key] = true
 
+		utxo, exists := view.lookup(input.Txn_id, input.Index)
 		if !exists {
-			return fmt.Errorf("input does not exist in the UTXO set")
+			return fmt.Errorf("input %s:%d: %w", input.Txn_id, input.Index, errMissingInput)
+		}
+
+		// Check the owner(s) of the UTXO signed the transaction
+		err := verifyInput(&txn, utxo, input)
+		if err != nil {
+			return fmt.Errorf("input %s:%d: %v", input.Txn_id, input.Index, err)
 		}
 
 		inputSum += utxo.Value
@@ -487,8 +1054,8 @@ func validateTransaction(txn Transaction) error {
 	// Check the negative sums
 	outputSum := 0.0
 	for _, output := range txn.Outputs {
-		if output.Value < 0 {
-			return fmt.Errorf("output value is negative")
+		if err := validateOutput(output); err != nil {
+			return err
 		}
 		outputSum += output.Value
 	}
@@ -501,8 +1068,46 @@ func validateTransaction(txn Transaction) error {
 	return nil
 }
 
-// Validation of a block by checking the previous hash, and all the transactions
+// Validation of a block by checking the seal, the previous hash, and all the transactions
 func validateBlock(block Block) error {
+	err := Engine.VerifySeal(block)
+	if err != nil {
+		return err
+	}
+
+	return validateBlockBody(block)
+}
+
+// Checks of the block contents that do not depend on the chain state
+func checkBlockSanity(block Block) error {
+	// Check the merkle root commits to the transactions
+	if buildMerkle(block.Transactions).Value != block.Merkle_hash {
+		return fmt.Errorf("merkle root does not match the transactions")
+	}
+
+	for idx, txn := range block.Transactions {
+		if idx > 0 && isCoinbase(txn) {
+			return fmt.Errorf("coinbase %s is not the first transaction", txn.Txn_id)
+		}
+
+		expected := txn
+		expected.generateTxn()
+		if expected.Txn_id != txn.Txn_id {
+			return fmt.Errorf("transaction %s id does not match its contents", txn.Txn_id)
+		}
+
+		for _, output := range txn.Outputs {
+			if err := validateOutput(output); err != nil {
+				return fmt.Errorf("transaction %s: %v", txn.Txn_id, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Validation of the contents of a block, sealed or not, against the current chain
+func validateBlockBody(block Block) error {
 	// Check if the previous hash is correct
 	BlockMutex.RLock()
 	previousBlock, exists := Blockchain[block.Previous_hash]
@@ -514,138 +1119,103 @@ func validateBlock(block Block) error {
 		return fmt.Errorf("previous hash does not match")
 	}
 
-	// Validate the transactions
-	for _, txn := range block.Transactions {
-		err := validateTransaction(txn)
+	err := checkBlockSanity(block)
+	if err != nil {
+		return err
+	}
+
+	// Validate the transactions in order - a transaction may spend the outputs of an earlier one, but not the outputs already spent
+	view := newUTXOView()
+	for idx, txn := range block.Transactions {
+		// The coinbase leads the block and has no inputs to check
+		if idx == 0 && isCoinbase(txn) {
+			expected := txn
+			expected.generateTxn()
+			if expected.Txn_id != txn.Txn_id {
+				return fmt.Errorf("coinbase id does not match its contents")
+			}
+
+			for _, output := range txn.Outputs {
+				if err := validateOutput(output); err != nil {
+					return fmt.Errorf("coinbase: %v", err)
+				}
+			}
+			view.apply(txn, block.Block_height)
+			continue
+		}
+
+		err := validateTransaction(txn, block.Block_height, block.Timestamp, view)
 		if err != nil {
 			return err
 		}
+		view.apply(txn, block.Block_height)
 	}
 
 	return nil
 }
 
 func startMining(block Block) {
-	if miningCancel != nil {
-		miningCancel() // Stop previous mining
-	}
+	miningMutex.Lock()
+	defer miningMutex.Unlock()
 
-	miningCtx, miningCancel = context.WithCancel(context.Background())
-	go mineBlock(miningCtx, block)
-}
+	// Stop previous mining
+	cancelMining()
 
-// Mining of a block
-func mineBlock(ctx context.Context, block Block) error {
+	miningCtx, miningCancel = context.WithCancel(context.Background())
+	miningDone = make(chan struct{})
 
-	// Check if the block is valid
-	err := validateBlock(block)
-	if err != nil {
-		return fmt.Errorf("block is invalid")
-	}
+	go func(ctx context.Context, done chan struct{}) {
+		defer close(done)
 
-	// Mine the block using generateBlockHash
-	nonce := int32(0)
-	foundValidBlock := false
-	for {
-		select {
-		case <-ctx.Done():
-			fmt.Println("Mining aborted due to new block arrival")
-			return fmt.Errorf("mining interrupted")
-		default:
-			block.Nonce = nonce
-			block.generateBlockHash()
-
-			// Check if the hash is valid
-			if block.Block_hash[:block.Difficulty] == "0000" {
-				foundValidBlock = true
-				break // This ensures the loop exits
-			}
-			nonce++
-		}
-		if foundValidBlock {
-			break // Break the for loop
+		err := mineBlock(ctx, block)
+		if err != nil {
+			fmt.Println("Mining stopped:", err)
 		}
-	}
+	}(miningCtx, miningDone)
+}
 
-	// Check if the current block height is the same as the latest block height
-	BlockMutex.RLock()
-	currentBlock := Blockchain[Latest_Block]
-	BlockMutex.RUnlock()
+// Stop mining the current block, if any, returning once its goroutine is done
+func stopMining() {
+	miningMutex.Lock()
+	defer miningMutex.Unlock()
 
-	if currentBlock.Block_height != block.Block_height-1 {
-		return fmt.Errorf("block at the height is already mined!! Please try again")
-	}
-
-	// Add the block to the blockchain
-	BlockMutex.Lock()
-	Blockchain[block.Block_hash] = block
-	BlockMutex.Unlock()
+	cancelMining()
+}
 
-	// Remove the transactions from the mempool
-	removeFromMempool(block)
+// Cancel the mining goroutine and wait for it - the caller holds miningMutex
+func cancelMining() {
+	if miningCancel == nil {
+		return
+	}
 
-	// Update the latest block
-	Latest_Block = block.Block_hash
+	miningCancel()
+	<-miningDone
+	miningCancel = nil
+}
 
-	// Broadcast the block to the peers
+// Mining of a block
+func mineBlock(ctx context.Context, block Block) error {
 
-	// Create BlockDTO
-	blockDTO := BlockDTO{
-		Block_hash:    block.Block_hash,
-		Block_height:  block.Block_height,
-		Previous_hash: block.Previous_hash,
-		Nonce:         block.Nonce,
-		Difficulty:    block.Difficulty,
-		Merkle_hash:   block.Merkle_hash,
-		Timestamp:     block.Timestamp,
-		Transactions:  []string{},
+	// Fill in the consensus fields
+	err := Engine.Prepare(&block)
+	if err != nil {
+		return fmt.Errorf("cannot seal the block: %v", err)
 	}
 
-	// Add the transactions to the BlockDTO
-	for _, txn := range block.Transactions {
-		blockDTO.Transactions = append(blockDTO.Transactions, txn.Txn_id)
+	// Check if the block is valid
+	err = validateBlockBody(block)
+	if err != nil {
+		return fmt.Errorf("block is invalid: %v", err)
 	}
 
-	// Propagate the block to all the connected peers
-	for _, peer := range peerArray {
-		// Create a new stream for the peer
-		stream, err := User.NewStream(context.Background(), peer.ID, protocol.ID(config.ProtocolID+"/propagate"))
-		if err != nil {
-			fmt.Println("Failed to create stream with peer:", peer.ID)
-			continue
-		}
-
-		// Create a buffered writer for the stream
-		rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
-
-		// Serialize the block to JSON
-		data, err := json.Marshal(blockDTO)
-		if err != nil {
-			fmt.Println("Failed to serialize block:", err)
-			stream.Close()
-			continue
-		}
-
-		// Send the serialized block
-		_, err = rw.WriteString(string(data) + "\n")
-		if err != nil {
-			fmt.Println("Failed to send block to peer:", peer.ID, err)
-			stream.Close()
-			continue
-		}
-
-		// Flush the buffer to ensure data is sent
-		err = rw.Flush()
-		if err != nil {
-			fmt.Println("Failed to flush data to peer:", peer.ID, err)
-			stream.Close()
-			continue
-		}
-
-		stream.Close()
+	// Seal the block with the consensus engine
+	err = Engine.Seal(ctx, &block)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	// Add the block to the blockchain and broadcast it to the peers
+	return submitBlock(block)
 }
 
 func createGenesis() {
@@ -659,23 +1229,19 @@ func createGenesis() {
 		}
 		genesisBlock.generateBlockHash()
 		Blockchain[genesisBlock.Block_hash] = genesisBlock
+		Block_Heights[0] = genesisBlock.Block_hash
 		Genesis_Block = genesisBlock.Block_hash
 		Latest_Block = genesisBlock.Block_hash
 	}
 }
 
 func startUp() error {
-	// Create the genesis block
-	createGenesis()
-
 	// Pick a random peer to sync the blockchain
-	peerMutex.RLock()
-	peers := peerArray
+	peers := connectedPeers()
 	if len(peers) == 0 {
 		return fmt.Errorf("no peers available")
 	}
 	randomPeer := peers[rand.Intn(len(peers))]
-	peerMutex.RUnlock()
 	fmt.Println("Syncing with peer:", randomPeer.ID.String())
 
 	err := syncBlockchain(randomPeer)
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestSendFunds(t *testing.T) {
+	resetState(t)
+	recipient := pubkeyHex(newKey(t))
+
+	UTXO_SET[utxoKey("funding", 3)] = UTXO{Txn_id: "funding", Index: 3, Value: 1, Pubkey: walletPubkey()}
+	UTXO_SET[utxoKey("foreign", 0)] = UTXO{Txn_id: "foreign", Index: 0, Value: 1, Pubkey: recipient}
+
+	for name, utxo := range map[string]string{"unknown output": utxoKey("unknown", 0), "output of another key": utxoKey("foreign", 0)} {
+		if _, err := sendFunds([]string{utxo}, []Output{{Pubkey: recipient, Value: 0.5}}, 0.01, false, 0); err == nil {
+			t.Errorf("%s spent", name)
+		}
+	}
+	if _, err := sendFunds([]string{utxoKey("funding", 3)}, []Output{{Pubkey: "peer id", Value: 0.5}}, 0.01, false, 0); err == nil {
+		t.Error("sent to a recipient that is not a public key")
+	}
+
+	txnID, err := sendFunds([]string{utxoKey("funding", 3)}, []Output{{Pubkey: recipient, Value: 0.5}}, 0.01, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txn, exists := Mempool[txnID]
+	if !exists {
+		t.Fatal("sent transaction missing from the mempool")
+	}
+	if txn.Inputs[0].Index != 3 {
+		t.Errorf("sent transaction spends index %d, want 3", txn.Inputs[0].Index)
+	}
+	if len(txn.Outputs) != 2 || txn.Outputs[1].Pubkey != walletPubkey() {
+		t.Errorf("outputs %+v, want the payment and the change to the wallet", txn.Outputs)
+	}
+
+	// Signed by the wallet, so it validates against the UTXO set
+	if err := validateTransaction(txn, 1, time.Now(), newUTXOView()); err != nil {
+		t.Errorf("sent transaction rejected: %v", err)
+	}
+}
+
+func TestCoinbasePaysMinerAddress(t *testing.T) {
+	resetState(t)
+	cold := pubkeyHex(newKey(t))
+	config.MinerAddress = cold
+
+	block, err := createBlock([]string{}, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if coinbase := block.Transactions[0]; coinbase.Outputs[0].Pubkey != cold || coinbase.Outputs[0].Value != 0.5 {
+		t.Errorf("coinbase pays %.8f to %s, want 0.5 to the miner address", coinbase.Outputs[0].Value, coinbase.Outputs[0].Pubkey)
+	}
+
+	// The old payout to the peer ID is not a key, and burns the reward
+	config.MinerAddress = User.ID().String()
+	burning, err := createBlock([]string{}, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		block Block
+		valid bool
+	}{{burning, false}, {block, true}} {
+		if err := Engine.Prepare(&test.block); err != nil {
+			t.Fatal(err)
+		}
+		if err := Engine.Seal(context.Background(), &test.block); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := acceptBlock(test.block); (err == nil) != test.valid {
+			t.Errorf("coinbase to %s: valid = %v, want %v (%v)", test.block.Transactions[0].Outputs[0].Pubkey, err == nil, test.valid, err)
+		}
+	}
+}
+
+func TestMerkleBranch(t *testing.T) {
+	for count := 1; count <= 7; count++ {
+		txns := make([]Transaction, count)
+		for idx := range txns {
+			txns[idx] = Transaction{Txn_id: fmt.Sprint("txn", idx)}
+		}
+		root := buildMerkle(txns)
+
+		for idx, txn := range txns {
+			branch := merkleBranch(root, idx, count)
+			if !verifyMerkleBranch(txn.Txn_id, idx, branch, root.Value) {
+				t.Errorf("branch of transaction %d of %d does not lead to the root", idx, count)
+			}
+
+			// The branch only proves the transaction at its own position
+			if count > 1 && verifyMerkleBranch(txn.Txn_id, (idx+1)%count, branch, root.Value) {
+				t.Errorf("branch of transaction %d of %d verifies at another index", idx, count)
+			}
+			if verifyMerkleBranch("other", idx, branch, root.Value) {
+				t.Errorf("branch of transaction %d of %d verifies another transaction", idx, count)
+			}
+		}
+	}
+}
+
+func TestBlockLocator(t *testing.T) {
+	resetState(t)
+
+	for height := 1; height <= 15; height++ {
+		if _, err := acceptBlock(makeBlock(t, tipBlock())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	heights := []int32{}
+	for _, hash := range blockLocator() {
+		heights = append(heights, Blockchain[hash].Block_height)
+	}
+
+	// Ten blocks back from the tip one by one, then doubling the step down to the genesis block
+	want := []int32{15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 4, 0}
+	if fmt.Sprint(heights) != fmt.Sprint(want) {
+		t.Errorf("locator at heights %v, want %v", heights, want)
+	}
+}
+
+func TestValidateHeaders(t *testing.T) {
+	resetState(t)
+
+	first := makeBlock(t, tipBlock())
+	second := makeBlock(t, first)
+	headers := []BlockHeader{first.header(), second.header()}
+
+	unlinked := []BlockHeader{second.header()}
+	forged := []BlockHeader{first.header(), second.header()}
+	forged[1].Timestamp = forged[1].Timestamp.Add(time.Second)
+
+	for name, invalid := range map[string][]BlockHeader{"unknown parent": unlinked, "forged seal": forged} {
+		if err := validateHeaders(invalid); err == nil {
+			t.Errorf("headers with an %s validated", name)
+		}
+	}
+	if len(Headers) != 0 {
+		t.Fatalf("invalid headers kept: %d", len(Headers))
+	}
+
+	if err := validateHeaders(headers); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(Headers) != 2 {
+		t.Errorf("%d headers kept, want 2", len(Headers))
+	}
+
+	// The synced headers count as work before their bodies arrive
+	blockWork := chainWork(first)
+	blockWork.Sub(blockWork, chainWork(tipBlock()))
+	want := new(big.Int).Add(chainWork(first), new(big.Int).Mul(blockWork, big.NewInt(2)))
+	if work := chainWork(makeBlock(t, second)); work.Cmp(want) != 0 {
+		t.Errorf("work %v through the headers, want %v", work, want)
+	}
+}
+
+// Serve the blocks the way /download/block does, from a chain the node does not have
+func serveBlocks(chain []Block, limit int32) network.StreamHandler {
+	return func(stream network.Stream) {
+		defer stream.Close()
+		wire := newWire(stream)
+
+		var request BlockRequest
+		wire.Read(msgBlockRequest, &request)
+
+		for idx, block := range chain {
+			if block.Block_hash != request.Hash {
+				continue
+			}
+
+			blocks := chain[idx:min(idx+int(min(request.Count, limit)), len(chain))]
+			wire.Write(msgCount, len(blocks))
+			for _, block := range blocks {
+				wire.Write(msgBlock, block)
+			}
+			wire.Flush()
+			return
+		}
+
+		wire.Write(msgNotFound, nil)
+		wire.Flush()
+	}
+}
+
+func TestGetBodies(t *testing.T) {
+	resetState(t)
+
+	// Three windows of blocks
+	chain := []Block{}
+	headers := []BlockHeader{}
+	parent := tipBlock()
+	for len(chain) < 2*bodyWindowSize+10 {
+		parent = makeBlock(t, parent)
+		chain = append(chain, parent)
+		headers = append(headers, parent.header())
+	}
+	if err := validateHeaders(headers); err != nil {
+		t.Fatal(err)
+	}
+
+	empty := remoteHost(t)
+	serveWire(empty, "/download/block", serveBlocks(nil, maxBlocksPerRequest))
+
+	if err := getBodies(headers, []peer.ID{empty.ID()}); err == nil {
+		t.Fatal("synced from a peer without the blocks")
+	}
+
+	// The empty peer drops out and the full one takes over its windows, sending a few blocks per response
+	full := remoteHost(t)
+	serveWire(full, "/download/block", serveBlocks(chain, 50))
+
+	if err := getBodies(headers, []peer.ID{empty.ID(), full.ID()}); err != nil {
+		t.Fatal(err)
+	}
+	if tip := tipBlock(); tip.Block_hash != parent.Block_hash {
+		t.Errorf("tip at height %d, want %d", tip.Block_height, parent.Block_height)
+	}
+	if len(Headers) != 0 {
+		t.Errorf("%d headers left after their bodies connected", len(Headers))
+	}
+}
+
+func TestSyncForgetsHeaders(t *testing.T) {
+	resetState(t)
+	remote := remoteHost(t)
+
+	chain := []Block{tipBlock()}
+	for len(chain) < 4 {
+		chain = append(chain, makeBlock(t, chain[len(chain)-1]))
+	}
+
+	// A peer announcing a better chain without serving its blocks
+	serveWire(remote, "/download/headers", func(stream network.Stream) {
+		defer stream.Close()
+		wire := newWire(stream)
+
+		var locator []string
+		wire.Read(msgLocator, &locator)
+		wire.Write(msgCount, len(chain)-1)
+		for _, block := range chain[1:] {
+			wire.Write(msgHeader, block.header())
+		}
+		wire.Flush()
+	})
+	serveWire(remote, "/download/block", serveBlocks(nil, maxBlocksPerRequest))
+
+	mempoolServed := make(chan bool)
+	serveWire(remote, "/download/mempool", func(stream network.Stream) {
+		defer close(mempoolServed)
+		defer stream.Close()
+		wire := newWire(stream)
+
+		wire.Write(msgCount, 0)
+		wire.Flush()
+		readList[string](wire, msgID)
+		wire.Write(msgCount, 0)
+		wire.Flush()
+	})
+
+	if err := syncBlockchain(peer.AddrInfo{ID: remote.ID()}); err == nil {
+		t.Error("synced without the blocks")
+	}
+	<-mempoolServed
+
+	if len(Headers) != 0 {
+		t.Errorf("%d headers left after a failed sync", len(Headers))
+	}
+}
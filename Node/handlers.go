@@ -1,50 +1,65 @@
 package main
 
 import (
-	"bufio"
-
 	"github.com/libp2p/go-libp2p/core/network"
 )
 
 // Messaging Stream Handlers
 func messageProtocol(stream network.Stream) {
-	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
-	go readData(rw)
+	wire := newWire(stream)
+	readData(wire)
 }
 
 // Propagation handlers
 func broadcastMessage(stream network.Stream) {
-	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
-	go propagateMessage(rw, stream)
+	wire := newWire(stream)
+	propagateMessage(wire, stream)
 }
 
 func broadcastTxn(stream network.Stream) {
-	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
-	go propagateTxn(rw, stream)
+	wire := newWire(stream)
+	propagateTxn(wire, stream)
 }
 
 func broadcastBlock(stream network.Stream) {
-	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
-	go propagateBlock(rw, stream)
+	wire := newWire(stream)
+	propagateBlock(wire, stream)
+}
+
+// Handshake handlers
+func exchangeHandshake(stream network.Stream) {
+	wire := newWire(stream)
+	answerHandshake(wire, stream)
+}
+
+// Multisig handlers
+func cosignTxn(stream network.Stream) {
+	wire := newWire(stream)
+	receivePartialTxn(wire, stream)
 }
 
 // Export Request handlers
+func exportHeaders(stream network.Stream) {
+	wire := newWire(stream)
+	downloadHeaders(wire, stream)
+}
+
 func exportBlockchain(stream network.Stream) {
-	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
-	downloadBlockchain(rw, stream)
+	wire := newWire(stream)
+	downloadBlockchain(wire, stream)
 }
 
 func exportMempool(stream network.Stream) {
-	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
-	downloadMempool(rw, stream)
+	wire := newWire(stream)
+	downloadMempool(wire, stream)
 }
 
 func exportBlock(stream network.Stream) {
-	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
-	go downloadBlock(rw, stream)
+	wire := newWire(stream)
+	downloadBlock(wire, stream)
 }
 
 func exportTransaction(stream network.Stream) {
-	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
-	go downloadTransaction(rw, stream)
+	wire := newWire(stream)
+	downloadTransaction(wire, stream)
 }
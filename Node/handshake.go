@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	protocolVersion    = 1 // Version of the node protocols, raised on incompatible changes
+	minProtocolVersion = 1 // Oldest version of the peers still accepted
+)
+
+// Services a node offers to its peers
+const (
+	serviceBlocks uint64 = 1 << iota // Serves the blocks, headers and mempool
+	serviceMining                    // Mines blocks
+	serviceWork                      // Hands out mining work to external miners
+)
+
+const userAgent = "/heat-ledger:1.0.0/"
+
+// Time a peer has to complete the handshake
+const handshakeTimeout = 10 * time.Second
+
+// Handshake describing the local node
+func localHandshake() Handshake {
+	services := serviceBlocks
+	if config.Mine {
+		services |= serviceMining
+	}
+	if config.WorkListen != "" {
+		services |= serviceWork
+	}
+
+	BlockMutex.RLock()
+	defer BlockMutex.RUnlock()
+
+	tip := Blockchain[Latest_Block]
+
+	return Handshake{
+		Version:    protocolVersion,
+		Genesis:    Genesis_Block,
+		Height:     tip.Block_height,
+		Tip:        tip.Block_hash,
+		Services:   services,
+		User_agent: userAgent,
+	}
+}
+
+// Check the peer speaks a supported version of the protocols and is on the same chain
+func checkHandshake(remote Handshake) error {
+	if remote.Version < minProtocolVersion {
+		return fmt.Errorf("incompatible protocol version %d, at least %d is needed", remote.Version, minProtocolVersion)
+	}
+
+	BlockMutex.RLock()
+	genesis := Genesis_Block
+	BlockMutex.RUnlock()
+
+	if remote.Genesis != genesis {
+		return fmt.Errorf("different genesis block %s", remote.Genesis)
+	}
+
+	return nil
+}
+
+// Run the handshake with a peer just connected to, disconnecting it when it is not compatible
+func handshake(ctx context.Context, peerID peer.ID) (Handshake, error) {
+	var remote Handshake
+
+	stream, wire, err := openStream(ctx, peerID, "/handshake")
+	if err != nil {
+		User.Network().ClosePeer(peerID)
+		return remote, fmt.Errorf("failed to create stream with peer: %s", peerID)
+	}
+	defer stream.Close()
+
+	stream.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	wire.Write(msgHandshake, localHandshake())
+	err = wire.Flush()
+	if err == nil {
+		err = wire.Read(msgHandshake, &remote)
+	}
+	if err == nil {
+		err = checkHandshake(remote)
+	}
+
+	if err != nil {
+		User.Network().ClosePeer(peerID)
+		return remote, err
+	}
+
+	recordHandshake(peerID, remote)
+	return remote, nil
+}
+
+// Answer the handshake of a peer that connected, disconnecting it when it is not compatible
+func answerHandshake(wire *Wire, strm network.Stream) {
+	defer strm.Close()
+
+	strm.SetDeadline(time.Now().Add(handshakeTimeout))
+	peerID := strm.Conn().RemotePeer()
+
+	var remote Handshake
+	err := wire.Read(msgHandshake, &remote)
+	if err != nil {
+		fmt.Println("Failed to read handshake from", peerID, err)
+		User.Network().ClosePeer(peerID)
+		return
+	}
+
+	// Answer either way, so the peer can tell why it is dropped
+	wire.Write(msgHandshake, localHandshake())
+	err = wire.Flush()
+	if err != nil {
+		fmt.Println("Failed to send handshake to", peerID, err)
+		return
+	}
+
+	err = checkHandshake(remote)
+	if err != nil {
+		fmt.Println("Disconnecting peer", peerID.String()+":", err)
+		User.Network().ClosePeer(peerID)
+		return
+	}
+
+	recordHandshake(peerID, remote)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+func TestCheckHandshake(t *testing.T) {
+	resetState(t)
+
+	local := localHandshake()
+	if local.Genesis != Genesis_Block || local.Services != serviceBlocks {
+		t.Errorf("local handshake %+v", local)
+	}
+
+	config.Mine, config.WorkListen = true, "127.0.0.1:0"
+	if services := localHandshake().Services; services != serviceBlocks|serviceMining|serviceWork {
+		t.Errorf("services %b of a mining node serving work", services)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*Handshake)
+		valid  bool
+	}{
+		{"same chain", func(*Handshake) {}, true},
+		{"newer version", func(remote *Handshake) { remote.Version = protocolVersion + 1 }, true},
+		{"older version", func(remote *Handshake) { remote.Version = minProtocolVersion - 1 }, false},
+		{"other genesis", func(remote *Handshake) { remote.Genesis = "other" }, false},
+	}
+
+	for _, test := range tests {
+		remote := local
+		test.modify(&remote)
+		if err := checkHandshake(remote); (err == nil) != test.valid {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	resetState(t)
+
+	remote := remoteHost(t)
+	serveWire(remote, "/handshake", exchangeHandshake)
+
+	if _, err := handshake(context.Background(), remote.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if entry, ready := lookupPeer(remote.ID().String()); !ready || entry.Handshake.Genesis != Genesis_Block {
+		t.Errorf("handshake of a compatible peer kept as %+v", entry.Handshake)
+	}
+
+	// A peer of another chain is dropped
+	other := remoteHost(t)
+	serveWire(other, "/handshake", func(stream network.Stream) {
+		defer stream.Close()
+		wire := newWire(stream)
+
+		var local Handshake
+		wire.Read(msgHandshake, &local)
+		local.Genesis = "other"
+		wire.Write(msgHandshake, local)
+		wire.Flush()
+	})
+
+	if _, err := handshake(context.Background(), other.ID()); err == nil {
+		t.Error("handshake with another chain succeeded")
+	}
+	if User.Network().Connectedness(other.ID()) == network.Connected {
+		t.Error("peer of another chain still connected")
+	}
+	if _, ready := lookupPeer(other.ID().String()); ready {
+		t.Error("peer of another chain kept")
+	}
+}
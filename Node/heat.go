@@ -4,7 +4,7 @@ import (
 	"bufio"
 	"context"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
 	"strconv"
@@ -19,7 +19,6 @@ import (
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
-	"github.com/libp2p/go-libp2p/core/protocol"
 	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
 	dutil "github.com/libp2p/go-libp2p/p2p/discovery/util"
 	"github.com/multiformats/go-multiaddr"
@@ -27,19 +26,19 @@ import (
 
 var logger = log.Logger("rendezvous")
 
-func readData(rw *bufio.ReadWriter) {
+func readData(wire *Wire) {
 	for {
-		str, err := rw.ReadString('\n')
+		var str string
+		err := wire.Read(msgText, &str)
+		if errors.Is(err, errBadMessage) {
+			continue
+		}
 		if err != nil {
 			fmt.Println("User Went Offline", err)
 			return
 		}
 
-		if str == "" || str == "\n" {
-			continue
-		}
-
-		fmt.Printf("\x1b[32m%s\x1b[0m> ", str)
+		fmt.Printf("\x1b[32m%s\x1b[0m\n> ", str)
 	}
 }
 
@@ -54,9 +53,41 @@ func main() {
 	reader := bufio.NewReader(os.Stdin)
 	privKeyString, _ := reader.ReadString('\n')
 	privKeyString = strings.TrimSpace(privKeyString)
-	privKeyBytes, _ := hex.DecodeString(privKeyString)
+	privKeyBytes, err := hex.DecodeString(privKeyString)
+	if err != nil {
+		fmt.Println("Private key is not valid hex:", err)
+		return
+	}
+
+	privKey, err := crypto.UnmarshalSecp256k1PrivateKey(privKeyBytes)
+	if err != nil {
+		fmt.Println("Failed to load the private key:", err)
+		return
+	}
+
+	// The same key signs the wallet's transactions
+	Wallet_Key = privKey
+
+	// Check the payout key now, so that a typo does not burn the mining rewards
+	config.MinerAddress, err = minerAddress(config.MinerAddress)
+	if err != nil {
+		fmt.Println("Invalid miner address:", err)
+		return
+	}
 
-	privKey, _ := crypto.UnmarshalSecp256k1PrivateKey(privKeyBytes)
+	// Restore the bans of the earlier runs
+	err = loadBanList()
+	if err != nil {
+		fmt.Println("Failed to load the ban list:", err)
+		return
+	}
+
+	// Keep the number of peers between the watermarks
+	connManager, err := newConnManager()
+	if err != nil {
+		fmt.Println("Failed to create the connection manager:", err)
+		return
+	}
 
 	// Creating the current node
 	User, err = libp2p.New(
@@ -64,23 +95,49 @@ func main() {
 		libp2p.ListenAddrs(
 			[]multiaddr.Multiaddr(config.ListenAddresses)...,
 		),
+		libp2p.ConnectionGater(banGater{}),
+		libp2p.ConnectionManager(connManager),
 	)
 	if err != nil {
 		panic(err)
 	}
 
 	// Display the public key
-	pubKey := privKey.GetPublic()
-	pubKeyBytes, _ := pubKey.Raw()
-	fmt.Println("Public Key (Hex):", hex.EncodeToString(pubKeyBytes))
+	fmt.Println("Public Key (Hex):", walletPubkey())
 
 	logger.Info("Node created with the ID: ", User.ID().String())
 
+	// Select the consensus engine
+	Engine, err = newConsensus(config, privKey, User.ID())
+	if err != nil {
+		fmt.Println("Failed to create the consensus engine:", err)
+		return
+	}
+	logger.Info("Using the consensus engine: ", Engine.Name())
+	logger.Info("Mining rewards are paid to: ", config.MinerAddress)
+
+	// Create the genesis block, which the handshakes with the peers compare
+	createGenesis()
+
 	// Set the handlers for the node
 	SetNodeHandlers()
 
-	// Extract Bootstrap peers
+	// Keep track of the connected peers, and of their value to the connection manager
+	trackPeers()
+	go managePeers()
+
+	// Expire the old mempool transactions
+	go maintainMempool()
+
+	// Relay the transactions, blocks and gossip messages over GossipSub
 	ctx := context.Background()
+	err = startPubsub(ctx)
+	if err != nil {
+		fmt.Println("Failed to start the pubsub relay:", err)
+		return
+	}
+
+	// Extract Bootstrap peers
 	bootstrapPeers := make([]peer.AddrInfo, len(config.BootstrapPeers))
 
 	// Add the Bootstrap peers to the peer slice
@@ -122,6 +179,12 @@ func main() {
 
 	go func() {
 		for {
+			// Look for peers only while the node needs more
+			if !needPeers() {
+				time.Sleep(peerCheckInterval)
+				continue
+			}
+
 			// Create a peer channel for all the available users
 			peerChan, err := routingDiscovery.FindPeers(ctx, config.RendezvousString)
 			if err != nil {
@@ -135,17 +198,27 @@ func main() {
 					continue
 				}
 
-				if _, exists := peerSet[peer.ID.String()]; exists {
+				if User.Network().Connectedness(peer.ID) == network.Connected {
+					continue
+				}
+
+				// The rest of the peers found are skipped once the slots are filled
+				if isBanned(peer.ID) || !needPeers() {
 					continue
 				}
 
 				if err := User.Connect(ctx, peer); err != nil {
 					logger.Warn("Failed to connect to peer:", err)
-				} else {
-					logger.Info("Connected to peer:", peer.ID.String())
-					peerArray = append(peerArray, peer)
-					peerSet[peer.ID.String()] = peer
+					continue
+				}
+
+				// Only the peers on the same chain are kept
+				if _, err := handshake(ctx, peer.ID); err != nil {
+					logger.Warn("Handshake failed with peer ", peer.ID.String(), ": ", err)
+					continue
 				}
+
+				logger.Info("Connected to peer:", peer.ID.String())
 			}
 
 			// The local DHT updates for every two seconds
@@ -160,6 +233,16 @@ func main() {
 		return
 	}
 
+	// Mine in the background on templates built from the mempool
+	if config.Mine {
+		go autoMine()
+	}
+
+	// Hand out work to the external miners
+	if config.WorkListen != "" {
+		go startWorkServer(config.WorkListen)
+	}
+
 	// For the user communication
 	reader = bufio.NewReader(os.Stdin)
 	var userStream network.Stream = nil
@@ -174,7 +257,14 @@ func main() {
 			"6: Validate Blockchain\n" +
 			"7: Validate Block\n" +
 			"8: Mine Block\n" +
-			"9: Exit)\n> ")
+			"9: Exit\n" +
+			"10: Sign Partial Transaction\n" +
+			"11: Estimate Fee\n" +
+			"12: List Banned Peers\n" +
+			"13: Ban Peer\n" +
+			"14: Unban Peer\n" +
+			"15: Display Peers\n" +
+			"16: Look Up Transaction)\n> ")
 		mode, err := reader.ReadString('\n')
 		if err != nil {
 			fmt.Println("Error reading the input")
@@ -207,13 +297,13 @@ func main() {
 				logger.Info("Connecting to user")
 
 				// Establish the Stream
-				targetUser, exists := peerSet[input]
+				targetUser, exists := lookupPeer(input)
 
 				if !exists {
 					println("User not found!")
 					continue
 				}
-				newStream, err := User.NewStream(ctx, targetUser.ID, protocol.ID(config.ProtocolID+"/message"))
+				newStream, _, err := openStream(ctx, targetUser.Info.ID, "/message")
 				if err != nil {
 					println("Error occurred creating a stream!\n")
 					continue
@@ -222,7 +312,7 @@ func main() {
 				// Set the current stream
 				userStream = newStream
 
-				logger.Info("Connected to: ", targetUser.ID.String())
+				logger.Info("Connected to: ", targetUser.Info.ID.String())
 			}
 
 			// Entering number of inputs, Outputs, Fee
@@ -236,14 +326,19 @@ func main() {
 			read = strings.TrimSpace(read)
 			outputs, _ := strconv.ParseInt(read, 10, 64)
 
-			println("> Enter Fee")
+			println("> Enter Fee (blank to estimate)")
 			read, _ = reader.ReadString('\n')
 			read = strings.TrimSpace(read)
+			estimate := read == ""
 			fee, _ := strconv.ParseFloat(read, 64)
 
+			println("> Enter Lock Time (block height or unix timestamp, blank for none)")
+			read, _ = reader.ReadString('\n')
+			read = strings.TrimSpace(read)
+			lockTime, _ := strconv.ParseInt(read, 10, 64)
+
 			utxos := make([]string, 0)
-			nodeID := make([]string, 0)
-			amounts := make([]float64, 0)
+			outputList := make([]Output, 0)
 
 			// Adding the UTXO hashes for the transaction
 			for i := 0; i < int(inputs); i++ {
@@ -253,21 +348,40 @@ func main() {
 				utxos = append(utxos, utxo)
 			}
 
-			// Adding the Node ID and Amount for the transaction
+			// Adding the recipient and Amount for the transaction
 			for i := 0; i < int(outputs); i++ {
-				println("> Enter Node ID")
+				println("> Enter Recipient Public Key (Hex), or m-of-n for a multisig output")
 				id, _ := reader.ReadString('\n')
 				id = strings.TrimSpace(id)
-				nodeID = append(nodeID, id)
+
+				output := Output{Pubkey: id}
+
+				// Lock the output to m of the n keys
+				var required, total int
+				if _, err := fmt.Sscanf(id, "%d-of-%d", &required, &total); err == nil {
+					output = Output{Required: int32(required)}
+					for j := 0; j < total; j++ {
+						println("> Enter Co-signer Public Key (Hex)")
+						key, _ := reader.ReadString('\n')
+						output.Pubkeys = append(output.Pubkeys, strings.TrimSpace(key))
+					}
+				}
 
 				println("> Enter Amount")
 				amt, _ := reader.ReadString('\n')
 				amt = strings.TrimSpace(amt)
-				amount, _ := strconv.ParseFloat(amt, 64)
-				amounts = append(amounts, amount)
+				output.Value, _ = strconv.ParseFloat(amt, 64)
+
+				println("> Enter Relative Lock in Blocks (blank for none)")
+				lock, _ := reader.ReadString('\n')
+				lock = strings.TrimSpace(lock)
+				lockBlocks, _ := strconv.ParseInt(lock, 10, 32)
+				output.Lock_blocks = int32(lockBlocks)
+
+				outputList = append(outputList, output)
 			}
 
-			txn_id, err := sendFunds(utxos, nodeID, amounts, fee)
+			txn_id, err := sendFunds(utxos, outputList, fee, estimate, lockTime)
 			if err != nil {
 				fmt.Println("Failed to send funds:", err)
 				continue
@@ -291,13 +405,12 @@ func main() {
 		// Sync the Blockchain and Mempool
 		if mode == "4" {
 			// Pick a random peer to sync the blockchain
-			peerMutex.RLock()
-			peers := peerArray
+			peers := connectedPeers()
 			if len(peers) == 0 {
+				fmt.Println("No peers available")
 				continue
 			}
 			randomPeer := peers[rand.Intn(len(peers))]
-			peerMutex.RUnlock()
 			fmt.Println("Syncing with peer:", randomPeer.ID.String())
 
 			err := syncBlockchain(randomPeer)
@@ -334,43 +447,9 @@ func main() {
 				Content:    sendData,
 			}
 
-			// Send the message to all connected peers (Gossip)
-			for _, peer := range peerArray {
-				// Create a new stream for the peer
-				stream, err := User.NewStream(ctx, peer.ID, protocol.ID(config.ProtocolID+"/gossip"))
-				if err != nil {
-					fmt.Println("Failed to create stream with peer:", peer.ID)
-					continue
-				}
-
-				// Create a buffered writer for the stream
-				rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
-
-				// Serialize the message to JSON
-				data, err := json.Marshal(message)
-				if err != nil {
-					fmt.Println("Failed to serialize message:", err)
-					stream.Close()
-					continue
-				}
-
-				// Send the serialized message
-				_, err = rw.WriteString(string(data) + "\n")
-				if err != nil {
-					fmt.Println("Failed to send message to peer:", peer.ID, err)
-					stream.Close()
-					continue
-				}
-
-				// Flush the buffer to ensure data is sent
-				err = rw.Flush()
-				if err != nil {
-					fmt.Println("Failed to flush data to peer:", peer.ID, err)
-					stream.Close()
-					continue
-				}
-
-				stream.Close()
+			// Publish the message to all connected peers (Gossip)
+			if publish(topicMessages, message) == 0 {
+				fmt.Println("Failed to communicate with any peers")
 			}
 		}
 
@@ -444,5 +523,127 @@ func main() {
 			startMining(block)
 			logger.Info("Mining the block")
 		}
+
+		// Co-sign a multisig transaction
+		if mode == "10" {
+			PartialMutex.RLock()
+			fmt.Println("Partial Transactions:")
+			for txnID, txn := range Partial_Txns {
+				fmt.Println(txnID, "missing signatures:", missingSignatures(&txn))
+			}
+			PartialMutex.RUnlock()
+
+			println("> Enter Transaction ID")
+			txnID, _ := reader.ReadString('\n')
+			txnID = strings.TrimSpace(txnID)
+
+			missing, err := signPartialTxn(txnID)
+			if err != nil {
+				fmt.Println("Failed to sign transaction:", err)
+				continue
+			}
+
+			if missing == 0 {
+				fmt.Println("Transaction fully signed and broadcast:", txnID)
+				continue
+			}
+
+			// Pass the transaction on to the next co-signer
+			println("> Enter Co-signer Node ID (blank to keep it here)")
+			nodeID, _ := reader.ReadString('\n')
+			nodeID = strings.TrimSpace(nodeID)
+			if nodeID == "" {
+				continue
+			}
+
+			err = sendPartialTxn(nodeID, txnID)
+			if err != nil {
+				fmt.Println("Failed to send transaction to co-signer:", err)
+				continue
+			}
+
+			fmt.Println("Transaction sent to co-signer:", nodeID)
+		}
+
+		// Estimate the fee rate to confirm within a number of blocks
+		if mode == "11" {
+			println("> Enter Confirmation Target in Blocks")
+			read, _ := reader.ReadString('\n')
+			target, err := strconv.Atoi(strings.TrimSpace(read))
+			if err != nil {
+				target = config.ConfTarget
+			}
+
+			fmt.Printf("Fee rate to confirm within %d block(s): %.8f per kB\n", target, estimateFee(target))
+		}
+
+		// Display the banned peers
+		if mode == "12" {
+			displayBanList()
+			continue
+		}
+
+		// Ban a peer by hand
+		if mode == "13" {
+			println("> Enter Peer ID")
+			read, _ := reader.ReadString('\n')
+			peerID, err := peer.Decode(strings.TrimSpace(read))
+			if err != nil {
+				fmt.Println("Invalid peer ID:", err)
+				continue
+			}
+
+			println("> Enter Ban Duration (e.g. 2h, blank for the default)")
+			read, _ = reader.ReadString('\n')
+			duration, err := time.ParseDuration(strings.TrimSpace(read))
+			if err != nil {
+				duration = config.BanTime
+			}
+
+			banPeer(peerID, duration)
+		}
+
+		// Lift the ban of a peer
+		if mode == "14" {
+			println("> Enter Peer ID")
+			read, _ := reader.ReadString('\n')
+			if unbanPeer(strings.TrimSpace(read)) {
+				fmt.Println("Peer unbanned")
+			} else {
+				fmt.Println("Peer is not banned")
+			}
+		}
+
+		// Display the connected peers
+		if mode == "15" {
+			displayPeers()
+			continue
+		}
+
+		// Fetch a transaction from a peer, checking its inclusion proof against the local chain
+		if mode == "16" {
+			println("> Enter Peer ID")
+			read, _ := reader.ReadString('\n')
+			target, exists := lookupPeer(strings.TrimSpace(read))
+			if !exists {
+				println("User not found!")
+				continue
+			}
+
+			println("> Enter Transaction ID")
+			read, _ = reader.ReadString('\n')
+			proof, err := fetchTransaction(target.Info.ID, strings.TrimSpace(read))
+			if err != nil {
+				fmt.Println("Failed to look up transaction:", err)
+				continue
+			}
+
+			if proof.Confirmed {
+				fmt.Printf("Transaction %s is confirmed in block %s at height %d, inclusion proof verified\n", proof.Transaction.Txn_id, proof.Block_hash, proof.Block_height)
+			} else {
+				fmt.Printf("Transaction %s is unconfirmed, in the mempool of the peer\n", proof.Transaction.Txn_id)
+			}
+			continue
+		}
 	}
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Lock times below this value are block heights, the rest are unix timestamps
+const lockTimeThreshold = 500000000
+
+// Check whether the transaction's lock time has passed for a block at the given height and time
+func isFinalTxn(txn Transaction, height int32, blockTime time.Time) bool {
+	if txn.Lock_time == 0 {
+		return true
+	}
+
+	if txn.Lock_time < lockTimeThreshold {
+		return int64(height) >= txn.Lock_time
+	}
+
+	return blockTime.Unix() >= txn.Lock_time
+}
+
+// Check the transaction lock time and the relative locks of the outputs it spends
+func checkLocks(txn Transaction, height int32, blockTime time.Time, view *UTXOView) error {
+	if !isFinalTxn(txn, height, blockTime) {
+		return fmt.Errorf("transaction is locked until %d", txn.Lock_time)
+	}
+
+	for _, input := range txn.Inputs {
+		utxo, exists := view.lookup(input.Txn_id, input.Index)
+
+		// Missing inputs are reported by the transaction validation
+		if !exists {
+			continue
+		}
+
+		if height < utxo.Height+utxo.Lock_blocks {
+			return fmt.Errorf("input %s:%d is locked until block %d", input.Txn_id, input.Index, utxo.Height+utxo.Lock_blocks)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsFinalTxn(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name     string
+		lockTime int64
+		height   int32
+		want     bool
+	}{
+		{"no lock time", 0, 1, true},
+		{"height reached", 10, 10, true},
+		{"height not reached", 10, 9, false},
+		{"timestamp passed", now.Unix() - 1, 1, true},
+		{"timestamp reached", now.Unix(), 1, true},
+		{"timestamp not reached", now.Unix() + 1, 1, false},
+		{"height ignored for a timestamp", now.Unix() + 1, 1 << 30, false},
+		{"below the threshold is a height", lockTimeThreshold - 1, 1 << 20, false},
+	}
+
+	for _, test := range tests {
+		txn := Transaction{Lock_time: test.lockTime}
+		if got := isFinalTxn(txn, test.height, now); got != test.want {
+			t.Errorf("%s: isFinalTxn = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// An output vesting for 10 blocks after its block at height 5 is spendable from height 15
+func TestRelativeLock(t *testing.T) {
+	resetState(t)
+	UTXO_SET[utxoKey("vesting", 0)] = UTXO{Txn_id: "vesting", Value: 1, Pubkey: walletPubkey(), Height: 5, Lock_blocks: 10}
+
+	txn := spendOutput("vesting", walletPubkey(), 0.9, 0.1)
+	if err := signInputs(&txn, Wallet_Key); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := validateTransaction(txn, 14, time.Now(), newUTXOView()); err == nil {
+		t.Error("locked output spent at height 14")
+	}
+	if err := validateTransaction(txn, 15, time.Now(), newUTXOView()); err != nil {
+		t.Errorf("output still locked at height 15: %v", err)
+	}
+
+	// The lock is part of the ID, so it cannot be stripped without the signature breaking
+	stripped := Transaction{Outputs: []Output{{Pubkey: walletPubkey(), Value: 1}}, Timestamp: txn.Timestamp}
+	locked := stripped
+	locked.Outputs = []Output{{Pubkey: walletPubkey(), Value: 1, Lock_blocks: 10}}
+	stripped.generateTxn()
+	locked.generateTxn()
+	if stripped.Txn_id == locked.Txn_id {
+		t.Error("relative lock not committed to by the transaction ID")
+	}
+}
+
+func TestSendFundsKeepsNonFinalOut(t *testing.T) {
+	resetState(t)
+	UTXO_SET[utxoKey("funding", 0)] = UTXO{Txn_id: "funding", Value: 1, Pubkey: walletPubkey()}
+
+	_, err := sendFunds([]string{utxoKey("funding", 0)}, []Output{{Pubkey: walletPubkey(), Value: 0.9}}, 0.1, false, 100)
+	if err == nil {
+		t.Fatal("transaction locked until height 100 submitted at height 1")
+	}
+	if len(Mempool) != 0 {
+		t.Errorf("%d non-final transactions in the mempool", len(Mempool))
+	}
+}
+
+func TestValidateOutputLock(t *testing.T) {
+	pubkey := pubkeyHex(newKey(t))
+
+	for lock, valid := range map[int32]bool{0: true, 10: true, -1: false} {
+		output := Output{Pubkey: pubkey, Value: 1, Lock_blocks: lock}
+		if err := validateOutput(output); (err == nil) != valid {
+			t.Errorf("lock of %d blocks: valid = %v, want %v (%v)", lock, err == nil, valid, err)
+		}
+	}
+}
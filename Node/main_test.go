@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// Start from empty node state with a fresh wallet key
+func resetState(t *testing.T) {
+	t.Helper()
+
+	Wallet_Key = newKey(t)
+	config = Config{
+		ProtocolID:      "/test",
+		MinRelayFee:     0.0001,
+		RBFIncrement:    0.0001,
+		MaxMempool:      300000000,
+		MempoolExpiry:   336 * time.Hour,
+		MaxAncestors:    25,
+		MaxAncestorSize: 101000,
+		ConfTarget:      6,
+		FallbackFee:     0.001,
+		BanScore:        100,
+		BanTime:         24 * time.Hour,
+		BanFile:         filepath.Join(t.TempDir(), "banlist.json"),
+	}
+	Engine = &PowEngine{Difficulty: 1}
+
+	Genesis_Block = ""
+	Latest_Block = ""
+	Blockchain = map[string]Block{}
+	Block_Heights = map[int32]string{}
+	Headers = map[string]BlockHeader{}
+	Merkle_Roots = map[string]*MerkleNode{}
+	Mempool = map[string]Transaction{}
+	UTXO_SET = map[string]UTXO{}
+	Transactions = map[string]Transaction{}
+	Partial_Txns = map[string]Transaction{}
+	Partial_Times = map[string]time.Time{}
+	Mempool_Spends = map[string]string{}
+	Mempool_Outs = map[string]UTXO{}
+	Mempool_Info = map[string]MempoolEntry{}
+	Mempool_Bytes = 0
+	Mempool_Evict = []string{}
+	workJobs = map[string]Block{}
+	workTemplate, workTemplateTip = Block{}, ""
+	rollingMinFee = 0
+	bucketTotal = make([]float64, len(feeBuckets))
+	bucketConfirmed = newConfirmStats(maxConfirmTarget, len(feeBuckets))
+
+	// The connections of the earlier tests may still be closing
+	peerMutex.Lock()
+	peerTable = map[string]*PeerEntry{}
+	peerMutex.Unlock()
+	LimitMutex.Lock()
+	Stream_Buckets = map[streamKey]*streamBucket{}
+	LimitMutex.Unlock()
+	BanMutex.Lock()
+	Peer_Scores = map[string]int{}
+	Ban_List = map[string]time.Time{}
+	BanMutex.Unlock()
+
+	createGenesis()
+
+	// A host without listen addresses, with the pubsub topics, for the code opening streams and publishing to the peers
+	if User == nil {
+		host, err := libp2p.New(libp2p.NoListenAddrs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		User = host
+		trackPeers()
+
+		err = startPubsub(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newKey(t *testing.T) crypto.PrivKey {
+	t.Helper()
+
+	key, _, err := crypto.GenerateKeyPair(crypto.Secp256k1, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func pubkeyHex(key crypto.PrivKey) string {
+	pubKeyBytes, _ := key.GetPublic().Raw()
+	return hex.EncodeToString(pubKeyBytes)
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Time for the raised minimum relay fee to decay by half
+const rollingFeeHalfLife = 12 * time.Hour
+
+// Most mempool transactions one replacement may evict, its conflicts and their descendants together
+const maxReplacements = 100
+
+// How often the mempool drops the expired transactions
+const mempoolExpiryInterval = time.Minute
+
+// Reasons a transaction is kept out of the mempool
+const (
+	rejectDuplicate = "duplicate"
+	rejectInvalid   = "invalid"
+	rejectMissing   = "missing-inputs"
+	rejectNonFinal  = "non-final"
+	rejectConflict  = "conflict"
+	rejectLowFee    = "insufficient-fee"
+	rejectChain     = "too-long-mempool-chain"
+)
+
+// Error returned when a transaction is not admitted to the mempool
+type RejectError struct {
+	Code   string
+	Reason string
+}
+
+func (err *RejectError) Error() string {
+	return err.Code + ": " + err.Reason
+}
+
+var (
+	rollingFeeMutex   sync.Mutex
+	rollingMinFee     float64   // Minimum fee rate raised by the evictions of a full mempool
+	rollingFeeUpdated time.Time // Last time the rolling fee decayed
+)
+
+func reject(code string, format string, args ...any) error {
+	return &RejectError{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Check whether the error only reports a transaction the node already has
+func isDuplicate(err error) bool {
+	rejectErr, ok := err.(*RejectError)
+	return ok && rejectErr.Code == rejectDuplicate
+}
+
+// The single admission path of the mempool - checks the inputs against the UTXO set,
+// the signatures, the fee and the conflicts with the transactions already in the mempool
+func acceptToMempool(txn Transaction) error {
+	MempoolMutex.Lock()
+	defer MempoolMutex.Unlock()
+
+	if _, exists := Mempool[txn.Txn_id]; exists {
+		return reject(rejectDuplicate, "already in the mempool")
+	}
+
+	TransMutex.RLock()
+	_, confirmed := Transactions[txn.Txn_id]
+	TransMutex.RUnlock()
+
+	if confirmed {
+		return reject(rejectDuplicate, "already confirmed")
+	}
+
+	if isCoinbase(txn) {
+		return reject(rejectInvalid, "coinbase is only valid in a block")
+	}
+
+	height := nextBlockHeight()
+	now := time.Now()
+
+	// The inputs may spend the outputs of other mempool transactions
+	view := newMempoolView(Mempool, height)
+
+	// Non-final transactions are kept out of the mempool
+	err := checkLocks(txn, height, now, view)
+	if err != nil {
+		return reject(rejectNonFinal, "%v", err)
+	}
+
+	// Mempool transactions spending the same outputs
+	conflicts := map[string]bool{}
+	for _, input := range txn.Inputs {
+		if spender, exists := Mempool_Spends[utxoKey(input.Txn_id, input.Index)]; exists {
+			conflicts[spender] = true
+		}
+	}
+
+	// Inputs, signatures and amounts
+	err = validateTransaction(txn, height, now, view)
+	if errors.Is(err, errMissingInput) {
+		return reject(rejectMissing, "%v", err)
+	}
+	if err != nil {
+		return reject(rejectInvalid, "%v", err)
+	}
+
+	// Limit the chains of unconfirmed transactions
+	ancestors := txnAncestors(txn, Mempool)
+	if len(ancestors)+1 > config.MaxAncestors {
+		return reject(rejectChain, "%d unconfirmed ancestors, the limit is %d", len(ancestors), config.MaxAncestors-1)
+	}
+
+	size := txnSize(txn)
+	ancestorSize := size
+	for _, ancestor := range ancestors {
+		ancestorSize += Mempool_Info[ancestor].Size
+	}
+	if ancestorSize > config.MaxAncestorSize {
+		return reject(rejectChain, "%d bytes with the unconfirmed ancestors, the limit is %d", ancestorSize, config.MaxAncestorSize)
+	}
+
+	rate := feeRate(txn.Fee, size)
+	if minFee := mempoolMinFee(); rate < minFee {
+		return reject(rejectLowFee, "fee rate %.8f is below the minimum %.8f", rate, minFee)
+	}
+
+	// Replace-by-fee - the conflicting transactions are evicted if the new one pays enough more
+	replaced := []string{}
+	if len(conflicts) > 0 {
+		replaced, err = checkReplacement(txn, size, conflicts)
+		if err != nil {
+			return err
+		}
+	}
+
+	// A transaction the full mempool would evict right away must not evict its conflicts first
+	if !fitsMempool(rate, size, ancestors, replaced) {
+		return reject(rejectLowFee, "mempool full")
+	}
+
+	if len(replaced) > 0 {
+		for _, txnID := range replaced {
+			deleteMempool(txnID)
+		}
+
+		fmt.Printf("\x1b[33m> Txn %s replaced %d mempool transaction(s)\x1b[0m\n", txn.Txn_id, len(replaced))
+	}
+
+	insertMempool(txn)
+
+	// Make room by dropping the worst paying transactions
+	trimMempool()
+
+	return nil
+}
+
+// Check whether the mempool can make room for a new transaction, once the replaced transactions are gone,
+// without evicting it or one of its ancestors. Follows the evictions of trimMempool.
+// The caller holds MempoolMutex.
+func fitsMempool(rate float64, size int, ancestors []string, replaced []string) bool {
+	excess := Mempool_Bytes + size - config.MaxMempool
+
+	gone := map[string]bool{}
+	for _, txnID := range replaced {
+		gone[txnID] = true
+		excess -= Mempool_Info[txnID].Size
+	}
+
+	parents := map[string]bool{}
+	for _, txnID := range ancestors {
+		parents[txnID] = true
+	}
+
+	// Walk the eviction index from the worst paying transaction, past the ones already gone
+	next := 0
+	for excess > 0 {
+		for next < len(Mempool_Evict) && gone[Mempool_Evict[next]] {
+			next++
+		}
+		worst := ""
+		if next < len(Mempool_Evict) {
+			worst = Mempool_Evict[next]
+		}
+
+		// The new transaction would be the worst paying one, or go with an evicted ancestor
+		if worst == "" || Mempool_Info[worst].Fee_rate >= rate || parents[worst] {
+			return false
+		}
+
+		for _, txnID := range append(mempoolDescendants(worst), worst) {
+			if parents[txnID] {
+				return false
+			}
+			if !gone[txnID] {
+				gone[txnID] = true
+				excess -= Mempool_Info[txnID].Size
+			}
+		}
+	}
+
+	return true
+}
+
+// Lowest fee rate admitted to the mempool, raised after evictions and decaying back to the configured minimum
+func mempoolMinFee() float64 {
+	rollingFeeMutex.Lock()
+	defer rollingFeeMutex.Unlock()
+
+	if rollingMinFee > 0 {
+		elapsed := time.Since(rollingFeeUpdated)
+		rollingMinFee *= math.Pow(0.5, elapsed.Hours()/rollingFeeHalfLife.Hours())
+		rollingFeeUpdated = time.Now()
+
+		// Back to the configured minimum once it has mostly decayed
+		if rollingMinFee < config.MinRelayFee/2 {
+			rollingMinFee = 0
+		}
+	}
+
+	return math.Max(config.MinRelayFee, rollingMinFee)
+}
+
+// Raise the minimum relay fee above the rate of an evicted transaction
+func raiseMinFee(rate float64) {
+	rollingFeeMutex.Lock()
+	defer rollingFeeMutex.Unlock()
+
+	if rate > rollingMinFee {
+		rollingMinFee = rate
+		rollingFeeUpdated = time.Now()
+	}
+}
+
+// Evict the lowest fee rate transactions, with their descendants, until the mempool fits the cap.
+// The caller holds MempoolMutex.
+func trimMempool() {
+	for Mempool_Bytes > config.MaxMempool && len(Mempool) > 0 {
+		worst := Mempool_Evict[0]
+
+		// New transactions have to pay more than the evicted one
+		raiseMinFee(Mempool_Info[worst].Fee_rate + config.MinRelayFee)
+
+		evicted := append(mempoolDescendants(worst), worst)
+		for _, txnID := range evicted {
+			deleteMempool(txnID)
+		}
+
+		fmt.Printf("\x1b[33m> Mempool full, evicted %d transaction(s)\x1b[0m\n", len(evicted))
+	}
+}
+
+// Periodically drop the expired transactions, also while no new transaction arrives
+func maintainMempool() {
+	for {
+		time.Sleep(mempoolExpiryInterval)
+
+		MempoolMutex.Lock()
+		expireMempool(time.Now())
+		MempoolMutex.Unlock()
+	}
+}
+
+// Drop the transactions waiting longer than the expiry, with their descendants.
+// The caller holds MempoolMutex.
+func expireMempool(now time.Time) {
+	expired := []string{}
+	for txnID, entry := range Mempool_Info {
+		if now.Sub(entry.Time) > config.MempoolExpiry {
+			expired = append(expired, txnID)
+		}
+	}
+
+	for _, txnID := range expired {
+		if _, exists := Mempool[txnID]; !exists {
+			continue
+		}
+
+		for _, descendant := range mempoolDescendants(txnID) {
+			deleteMempool(descendant)
+		}
+		deleteMempool(txnID)
+	}
+
+	if len(expired) > 0 {
+		fmt.Printf("\x1b[33m> Expired %d mempool transaction(s)\x1b[0m\n", len(expired))
+	}
+}
+
+// Check a transaction pays enough to replace its conflicts and their descendants, which are returned.
+// The caller holds MempoolMutex.
+func checkReplacement(txn Transaction, size int, conflicts map[string]bool) ([]string, error) {
+	replaced := map[string]bool{}
+	for txnID := range conflicts {
+		replaced[txnID] = true
+		for _, descendant := range mempoolDescendants(txnID) {
+			replaced[descendant] = true
+		}
+
+		if len(replaced) > maxReplacements {
+			return nil, reject(rejectConflict, "would evict more than %d mempool transactions", maxReplacements)
+		}
+	}
+
+	replacedFee := 0.0
+	maxRate := 0.0
+	for txnID := range replaced {
+		replacedFee += Mempool[txnID].Fee
+		if rate := Mempool_Info[txnID].Fee_rate; rate > maxRate {
+			maxRate = rate
+		}
+	}
+
+	// The replacement cannot depend on a transaction it evicts
+	for _, input := range txn.Inputs {
+		if replaced[input.Txn_id] {
+			return nil, reject(rejectConflict, "spends an output of the replaced transaction %s", input.Txn_id)
+		}
+	}
+
+	// Higher absolute fee, paying for its own relay
+	minFee := replacedFee + config.RBFIncrement*float64(size)/1000
+	if txn.Fee < minFee {
+		return nil, reject(rejectConflict, "replacement fee %.8f is below %.8f", txn.Fee, minFee)
+	}
+
+	// Higher fee rate
+	if rate := feeRate(txn.Fee, size); rate < maxRate+config.RBFIncrement {
+		return nil, reject(rejectConflict, "replacement fee rate %.8f is below %.8f", rate, maxRate+config.RBFIncrement)
+	}
+
+	txnIDs := make([]string, 0, len(replaced))
+	for txnID := range replaced {
+		txnIDs = append(txnIDs, txnID)
+	}
+
+	return txnIDs, nil
+}
+
+// Mempool transactions spending the outputs of the transaction, directly or through other mempool transactions.
+// The caller holds MempoolMutex.
+func mempoolDescendants(txnID string) []string {
+	descendants := []string{}
+	seen := map[string]bool{txnID: true}
+	queue := []string{txnID}
+
+	for len(queue) > 0 {
+		parent := Mempool[queue[0]]
+		queue = queue[1:]
+
+		for idx := range parent.Outputs {
+			child, exists := Mempool_Spends[utxoKey(parent.Txn_id, int32(idx))]
+			if !exists || seen[child] {
+				continue
+			}
+
+			seen[child] = true
+			descendants = append(descendants, child)
+			queue = append(queue, child)
+		}
+	}
+
+	return descendants
+}
+
+// Transactions of the pool the transaction spends, directly or through other transactions of the pool
+func txnAncestors(txn Transaction, pool map[string]Transaction) []string {
+	ancestors := []string{}
+	seen := map[string]bool{txn.Txn_id: true}
+	queue := []Transaction{txn}
+
+	for len(queue) > 0 {
+		child := queue[0]
+		queue = queue[1:]
+
+		for _, input := range child.Inputs {
+			parent, exists := pool[input.Txn_id]
+			if !exists || seen[parent.Txn_id] {
+				continue
+			}
+
+			seen[parent.Txn_id] = true
+			ancestors = append(ancestors, parent.Txn_id)
+			queue = append(queue, parent)
+		}
+	}
+
+	return ancestors
+}
+
+// Add a transaction and index the outputs it spends - the caller holds MempoolMutex
+func insertMempool(txn Transaction) {
+	Mempool[txn.Txn_id] = txn
+	Mempool_Gen++
+
+	size := txnSize(txn)
+	Mempool_Info[txn.Txn_id] = MempoolEntry{Time: time.Now(), Size: size, Fee_rate: feeRate(txn.Fee, size), Height: nextBlockHeight()}
+	Mempool_Bytes += size
+
+	idx := evictionIndex(txn.Txn_id)
+	Mempool_Evict = append(Mempool_Evict, "")
+	copy(Mempool_Evict[idx+1:], Mempool_Evict[idx:])
+	Mempool_Evict[idx] = txn.Txn_id
+
+	for _, input := range txn.Inputs {
+		Mempool_Spends[utxoKey(input.Txn_id, input.Index)] = txn.Txn_id
+	}
+	for idx, output := range txn.Outputs {
+		Mempool_Outs[utxoKey(txn.Txn_id, int32(idx))] = newUTXO(txn.Txn_id, int32(idx), output, 0)
+	}
+}
+
+// Position of a mempool transaction in the eviction index, ordered by fee rate and then ID.
+// The caller holds MempoolMutex.
+func evictionIndex(txnID string) int {
+	rate := Mempool_Info[txnID].Fee_rate
+	return sort.Search(len(Mempool_Evict), func(i int) bool {
+		other := Mempool_Info[Mempool_Evict[i]].Fee_rate
+		return other > rate || other == rate && Mempool_Evict[i] >= txnID
+	})
+}
+
+// Remove a transaction and its spent outputs from the index - the caller holds MempoolMutex
+func deleteMempool(txnID string) {
+	txn, exists := Mempool[txnID]
+	if !exists {
+		return
+	}
+
+	for _, input := range txn.Inputs {
+		key := utxoKey(input.Txn_id, input.Index)
+		if Mempool_Spends[key] == txnID {
+			delete(Mempool_Spends, key)
+		}
+	}
+	for idx := range txn.Outputs {
+		delete(Mempool_Outs, utxoKey(txnID, int32(idx)))
+	}
+
+	if idx := evictionIndex(txnID); idx < len(Mempool_Evict) && Mempool_Evict[idx] == txnID {
+		Mempool_Evict = append(Mempool_Evict[:idx], Mempool_Evict[idx+1:]...)
+	}
+
+	Mempool_Bytes -= Mempool_Info[txnID].Size
+	delete(Mempool_Info, txnID)
+	delete(Mempool, txnID)
+	Mempool_Gen++
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func rejectCode(err error) string {
+	var rejectErr *RejectError
+	if errors.As(err, &rejectErr) {
+		return rejectErr.Code
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// Wallet signed spend of a fresh wallet output worth 1, created in the genesis block
+func fundedSpend(t *testing.T, funding string, fee float64) Transaction {
+	t.Helper()
+
+	UTXO_SET[utxoKey(funding, 0)] = UTXO{Txn_id: funding, Value: 1, Pubkey: walletPubkey()}
+	Transactions[funding] = Transaction{Txn_id: funding, Block_hash: Genesis_Block, Outputs: []Output{{Pubkey: walletPubkey(), Value: 1}}}
+
+	txn := spendOutput(funding, walletPubkey(), 1-fee, fee)
+	if err := signInputs(&txn, Wallet_Key); err != nil {
+		t.Fatal(err)
+	}
+	return txn
+}
+
+func TestAcceptToMempool(t *testing.T) {
+	resetState(t)
+
+	accepted := fundedSpend(t, "accepted", 0.01)
+	if err := acceptToMempool(accepted); err != nil {
+		t.Fatalf("valid transaction rejected: %v", err)
+	}
+
+	forged := fundedSpend(t, "forged", 0.01)
+	forged.Inputs[0].Signature, _ = signTxn(&forged, newKey(t))
+
+	locked := spendOutput("locked", walletPubkey(), 0.99, 0.01)
+	UTXO_SET[utxoKey("locked", 0)] = UTXO{Txn_id: "locked", Value: 1, Pubkey: walletPubkey()}
+	locked.Lock_time = 1000
+	locked.generateTxn()
+	signInputs(&locked, Wallet_Key)
+
+	// Same input as the accepted one, without paying for a replacement
+	conflict := spendOutput("accepted", walletPubkey(), 0.99, 0.01)
+	signInputs(&conflict, Wallet_Key)
+
+	coinbase := Transaction{Outputs: []Output{{Pubkey: walletPubkey(), Value: 1}}}
+	coinbase.generateTxn()
+
+	for txn, want := range map[*Transaction]string{
+		&accepted: rejectDuplicate,
+		&forged:   rejectInvalid,
+		&locked:   rejectNonFinal,
+		&conflict: rejectConflict,
+		&coinbase: rejectInvalid,
+	} {
+		if got := rejectCode(acceptToMempool(*txn)); got != want {
+			t.Errorf("%s rejected with %q, want %q", txn.Txn_id, got, want)
+		}
+	}
+
+	free := fundedSpend(t, "free", 0)
+	if got := rejectCode(acceptToMempool(free)); got != rejectLowFee {
+		t.Errorf("transaction without a fee rejected with %q, want %q", got, rejectLowFee)
+	}
+
+	if len(Mempool) != 1 || len(Mempool_Spends) != 1 {
+		t.Errorf("%d transactions spending %d outputs in the mempool, want 1", len(Mempool), len(Mempool_Spends))
+	}
+}
+
+// A block confirming a double spend of a mempool transaction evicts it
+func TestConfirmedConflictLeavesMempool(t *testing.T) {
+	resetState(t)
+
+	pending := fundedSpend(t, "funding", 0.01)
+	if err := acceptToMempool(pending); err != nil {
+		t.Fatal(err)
+	}
+
+	rival := spendOutput("funding", walletPubkey(), 0.9, 0.1)
+	signInputs(&rival, Wallet_Key)
+	if _, err := acceptBlock(makeBlock(t, tipBlock(), rival)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(Mempool) != 0 || len(Mempool_Spends) != 0 {
+		t.Errorf("%d transactions spending %d outputs left in the mempool", len(Mempool), len(Mempool_Spends))
+	}
+}
+
+// A full mempool evicts the worst paying transaction and raises the fee the next one must pay
+func TestTrimMempool(t *testing.T) {
+	resetState(t)
+
+	cheap := fundedSpend(t, "cheap", 0.001)
+	rich := fundedSpend(t, "rich", 0.01)
+	for _, txn := range []Transaction{cheap, rich} {
+		if err := acceptToMempool(txn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	child := spendOutput(cheap.Txn_id, walletPubkey(), 0.99, 0.05)
+	MempoolMutex.Lock()
+	insertMempool(child)
+	MempoolMutex.Unlock()
+
+	// Room for two of the three transactions
+	config.MaxMempool = Mempool_Bytes - 1
+	richer := fundedSpend(t, "richer", 0.02)
+	if err := acceptToMempool(richer); err != nil {
+		t.Fatalf("well paying transaction rejected from a full mempool: %v", err)
+	}
+
+	for _, txn := range []Transaction{cheap, child} {
+		if _, exists := Mempool[txn.Txn_id]; exists {
+			t.Errorf("%s kept in the full mempool", txn.Txn_id)
+		}
+	}
+	if len(Mempool) != 2 || Mempool_Bytes > config.MaxMempool {
+		t.Errorf("%d transactions of %d bytes left, cap %d", len(Mempool), Mempool_Bytes, config.MaxMempool)
+	}
+
+	// The evicted fee rate is no longer enough
+	if minFee := mempoolMinFee(); minFee <= feeRate(cheap.Fee, txnSize(cheap)) {
+		t.Errorf("minimum fee %.8f not raised above the evicted %.8f", minFee, feeRate(cheap.Fee, txnSize(cheap)))
+	}
+	if got := rejectCode(acceptToMempool(fundedSpend(t, "late", 0.001))); got != rejectLowFee {
+		t.Errorf("transaction paying the evicted rate rejected with %q, want %q", got, rejectLowFee)
+	}
+}
+
+func TestEvictionIndex(t *testing.T) {
+	resetState(t)
+
+	for idx, fee := range []float64{0.03, 0.001, 0.02, 0.002, 0.05} {
+		mempoolTxn(fmt.Sprint("txn", idx), fee, 0)
+	}
+	deleteMempool("txn2")
+	deleteMempool("unknown")
+
+	// Worst paying first
+	want := []string{"txn1", "txn3", "txn0", "txn4"}
+	if fmt.Sprint(Mempool_Evict) != fmt.Sprint(want) {
+		t.Errorf("eviction order %v, want %v", Mempool_Evict, want)
+	}
+}
+
+func TestFindUTXOByKey(t *testing.T) {
+	resetState(t)
+
+	parent := fundedSpend(t, "funding", 0.01)
+	if err := acceptToMempool(parent); err != nil {
+		t.Fatal(err)
+	}
+	key := utxoKey(parent.Txn_id, 0)
+
+	if utxo, exists := findUTXOByKey(key); !exists || utxo.Value != parent.Outputs[0].Value || utxo.Height != nextBlockHeight() {
+		t.Errorf("mempool output %+v, exists = %v", utxo, exists)
+	}
+	if _, exists := findUTXOByKey(utxoKey(parent.Txn_id, 1)); exists {
+		t.Error("output past the end of the transaction found")
+	}
+
+	// Spent by a mempool child, and gone with the transaction
+	child := spendOutput(parent.Txn_id, walletPubkey(), 0.98, 0.01)
+	MempoolMutex.Lock()
+	insertMempool(child)
+	MempoolMutex.Unlock()
+	if _, exists := findUTXOByKey(key); exists {
+		t.Error("output spent in the mempool found")
+	}
+
+	MempoolMutex.Lock()
+	deleteMempool(child.Txn_id)
+	deleteMempool(parent.Txn_id)
+	MempoolMutex.Unlock()
+	if _, exists := findUTXOByKey(key); exists || len(Mempool_Outs) != 0 {
+		t.Errorf("output found after the transaction left the mempool, %d outputs indexed", len(Mempool_Outs))
+	}
+}
+
+func TestMempoolMinFeeDecays(t *testing.T) {
+	resetState(t)
+
+	rollingMinFee = 0.08
+	rollingFeeUpdated = time.Now().Add(-rollingFeeHalfLife)
+	if minFee := mempoolMinFee(); math.Abs(minFee-0.04) > 0.0001 {
+		t.Errorf("minimum fee %.8f after a half life, want 0.04", minFee)
+	}
+
+	rollingFeeUpdated = time.Now().Add(-20 * rollingFeeHalfLife)
+	if minFee := mempoolMinFee(); minFee != config.MinRelayFee || rollingMinFee != 0 {
+		t.Errorf("minimum fee %.8f once decayed, want the configured %.8f", minFee, config.MinRelayFee)
+	}
+}
+
+func TestExpireMempool(t *testing.T) {
+	resetState(t)
+
+	old := fundedSpend(t, "old", 0.01)
+	fresh := fundedSpend(t, "fresh", 0.01)
+	for _, txn := range []Transaction{old, fresh} {
+		if err := acceptToMempool(txn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	child := spendOutput(old.Txn_id, walletPubkey(), 0.98, 0.01)
+	MempoolMutex.Lock()
+	insertMempool(child)
+	MempoolMutex.Unlock()
+
+	entry := Mempool_Info[old.Txn_id]
+	entry.Time = time.Now().Add(-config.MempoolExpiry - time.Minute)
+	Mempool_Info[old.Txn_id] = entry
+
+	expireMempool(time.Now())
+
+	if _, exists := Mempool[fresh.Txn_id]; !exists || len(Mempool) != 1 {
+		t.Errorf("%d transactions left, want the recent one alone", len(Mempool))
+	}
+	if len(Mempool_Info) != 1 || Mempool_Bytes != Mempool_Info[fresh.Txn_id].Size {
+		t.Errorf("bookkeeping of %d entries and %d bytes left", len(Mempool_Info), Mempool_Bytes)
+	}
+}
+
+func TestMempoolChains(t *testing.T) {
+	resetState(t)
+	config.MaxAncestors = 2
+
+	// Each spend is signed once its parent is in the mempool
+	spend := func(parent Transaction, value float64) Transaction {
+		txn := spendOutput(parent.Txn_id, walletPubkey(), value, 0.01)
+		if err := signInputs(&txn, Wallet_Key); err != nil {
+			t.Fatal(err)
+		}
+		return txn
+	}
+
+	parent := fundedSpend(t, "funding", 0.01)
+	if err := acceptToMempool(parent); err != nil {
+		t.Fatal(err)
+	}
+	child := spend(parent, 0.98)
+	if err := acceptToMempool(child); err != nil {
+		t.Fatalf("chained spend rejected: %v", err)
+	}
+	grandchild := spend(child, 0.97)
+
+	if got := rejectCode(acceptToMempool(grandchild)); got != rejectChain {
+		t.Errorf("third transaction of a chain limited to two rejected with %q, want %q", got, rejectChain)
+	}
+
+	config.MaxAncestors = 25
+	config.MaxAncestorSize = Mempool_Bytes
+	if got := rejectCode(acceptToMempool(grandchild)); got != rejectChain {
+		t.Errorf("chain over the size limit rejected with %q, want %q", got, rejectChain)
+	}
+
+	config.MaxAncestorSize = 101000
+	if err := acceptToMempool(grandchild); err != nil {
+		t.Errorf("chain within the limits rejected: %v", err)
+	}
+}
+
+func TestSubmitTransactionWithoutPeers(t *testing.T) {
+	resetState(t)
+
+	txn := fundedSpend(t, "funding", 0.01)
+	if err := submitTransaction(&txn); err != nil {
+		t.Fatalf("transaction admitted to the mempool reported as failed: %v", err)
+	}
+	if _, exists := Mempool[txn.Txn_id]; !exists {
+		t.Fatal("submitted transaction missing from the mempool")
+	}
+}
+
+func TestReorganizeResubmitsTransactions(t *testing.T) {
+	resetState(t)
+	genesis := tipBlock()
+
+	kept := fundedSpend(t, "kept", 0.01)
+	doubleSpent := fundedSpend(t, "spent", 0.01)
+
+	// The fork spends the same output as one of the main chain transactions
+	rival := spendOutput("spent", walletPubkey(), 0.98, 0.02)
+	if err := signInputs(&rival, Wallet_Key); err != nil {
+		t.Fatal(err)
+	}
+
+	main := makeBlock(t, genesis, kept, doubleSpent)
+	if _, err := acceptBlock(main); err != nil {
+		t.Fatal(err)
+	}
+
+	fork := makeBlock(t, genesis, rival)
+	if _, err := acceptBlock(fork); err != nil {
+		t.Fatal(err)
+	}
+	if tipChanged, err := acceptBlock(makeBlock(t, fork)); err != nil || !tipChanged {
+		t.Fatalf("longer fork: tip changed = %v, err = %v", tipChanged, err)
+	}
+
+	if _, exists := Mempool[kept.Txn_id]; !exists {
+		t.Error("transaction of the undone block not returned to the mempool")
+	}
+	if _, exists := Mempool[doubleSpent.Txn_id]; exists {
+		t.Error("transaction conflicting with the new chain returned to the mempool")
+	}
+	if _, exists := Mempool[rival.Txn_id]; exists {
+		t.Error("transaction confirmed by the new chain left in the mempool")
+	}
+	if Mempool_Info[kept.Txn_id].Time.IsZero() {
+		t.Error("resubmitted transaction has no arrival time")
+	}
+}
+
+func TestFullMempoolReplacement(t *testing.T) {
+	tests := []struct {
+		name     string
+		otherFee float64 // Fee of the other mempool transaction, competing for the space
+		want     string
+	}{
+		{"replacement pays less than the rest", 0.05, rejectLowFee},
+		{"replacement pays more than the rest", 0.015, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetState(t)
+
+			original := fundedSpend(t, "funding", 0.01)
+			other := fundedSpend(t, "other", test.otherFee)
+			for _, txn := range []Transaction{original, other} {
+				if err := acceptToMempool(txn); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The replacement does not fit without an eviction
+			config.MaxMempool = Mempool_Bytes - Mempool_Info[original.Txn_id].Size/2
+
+			replacement := fundedSpend(t, "funding", 0.02)
+			err := acceptToMempool(replacement)
+			if got := rejectCode(err); got != test.want {
+				t.Fatalf("rejected with %q, want %q (%v)", got, test.want, err)
+			}
+
+			_, originalKept := Mempool[original.Txn_id]
+			_, replacementKept := Mempool[replacement.Txn_id]
+			if accepted := test.want == ""; originalKept == accepted || replacementKept != accepted {
+				t.Errorf("original kept = %v, replacement kept = %v, want the replacement accepted = %v", originalKept, replacementKept, accepted)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	work "blockchain-app/Work"
+)
+
+// Search the whole nonce space of the block across the workers.
+// Reports whether a nonce meeting the difficulty was found, and stops early when the context is cancelled.
+func searchNonces(ctx context.Context, block *Block, workers int) (bool, error) {
+	prefix, suffix := block.headerParts()
+
+	nonce, blockHash, found := work.Search(ctx, prefix, suffix, block.Difficulty, workers)
+	if found {
+		block.Nonce = nonce
+		block.Block_hash = blockHash
+		return true, nil
+	}
+
+	// Cancelled from outside, rather than out of nonces
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+
+	return false, nil
+}
+
+// Change the header once the nonce space is exhausted - roll the coinbase extra nonce, or bump the timestamp
+func rollExtraNonce(block *Block) {
+	if len(block.Transactions) > 0 && isCoinbase(block.Transactions[0]) {
+		block.Transactions[0].Extra_nonce++
+		block.Transactions[0].generateTxn()
+
+		// The coinbase ID changed, so does the merkle root
+		block.Merkle_hash = buildMerkle(block.Transactions).Value
+		return
+	}
+
+	block.Timestamp = block.Timestamp.Add(time.Second)
+}
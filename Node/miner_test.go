@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSearchNonces(t *testing.T) {
+	for _, workers := range []int{0, 1, 4} {
+		t.Run(fmt.Sprint(workers, " workers"), func(t *testing.T) {
+			block := Block{Block_height: 1, Previous_hash: "parent", Merkle_hash: "root", Difficulty: 2, Timestamp: time.Now()}
+
+			found, err := searchNonces(context.Background(), &block, workers)
+			if !found || err != nil {
+				t.Fatalf("found = %v, err = %v", found, err)
+			}
+
+			// The hash of the split header is the hash of the whole header
+			expected := block
+			expected.generateBlockHash()
+			if expected.Block_hash != block.Block_hash {
+				t.Errorf("search hash %s, header hash %s", block.Block_hash, expected.Block_hash)
+			}
+			if err := (&PowEngine{Difficulty: 2}).VerifySeal(block); err != nil {
+				t.Errorf("found nonce does not seal the block: %v", err)
+			}
+		})
+	}
+}
+
+func TestSearchNoncesCancelled(t *testing.T) {
+	block := Block{Block_height: 1, Difficulty: 64, Timestamp: time.Now()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	found, err := searchNonces(ctx, &block, 4)
+	if found || err == nil {
+		t.Fatalf("found = %v, err = %v after cancelling", found, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("workers stopped %v after the cancellation", elapsed)
+	}
+}
+
+func TestRollExtraNonce(t *testing.T) {
+	resetState(t)
+
+	block := makeBlock(t, tipBlock())
+	merkle, timestamp := block.Merkle_hash, block.Timestamp
+
+	rollExtraNonce(&block)
+	if block.Transactions[0].Extra_nonce != 1 || block.Merkle_hash == merkle || !block.Timestamp.Equal(timestamp) {
+		t.Errorf("coinbase block: extra nonce %d, merkle changed = %v, timestamp changed = %v",
+			block.Transactions[0].Extra_nonce, block.Merkle_hash != merkle, !block.Timestamp.Equal(timestamp))
+	}
+	if block.Merkle_hash != buildMerkle(block.Transactions).Value {
+		t.Error("merkle root does not match the rolled coinbase")
+	}
+
+	// Without a coinbase, the timestamp moves instead
+	bare := Block{Timestamp: timestamp}
+	rollExtraNonce(&bare)
+	if !bare.Timestamp.Equal(timestamp.Add(time.Second)) {
+		t.Errorf("timestamp moved by %v, want a second", bare.Timestamp.Sub(timestamp))
+	}
+}
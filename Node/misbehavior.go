@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// Misbehavior score of each violation - a peer reaching the ban score is disconnected and banned
+const (
+	penaltyMalformed    = 20  // Message that cannot be decoded
+	penaltyInvalidTxn   = 10  // Transaction failing the validation
+	penaltyInvalidBlock = 100 // Block or header failing the validation
+	penaltyRateLimit    = 5   // Stream opened beyond the rate or concurrency limits of its protocol
+)
+
+// Misbehavior score forgiven at every round of the peer management
+const scoreDecay = 1
+
+// Add to the misbehavior score of a peer, banning it once the score reaches the ban score
+func misbehaving(peerID peer.ID, penalty int, reason string) {
+	BanMutex.Lock()
+	Peer_Scores[peerID.String()] += penalty
+	score := Peer_Scores[peerID.String()]
+
+	banned := score >= config.BanScore
+	if banned {
+		delete(Peer_Scores, peerID.String())
+	}
+	BanMutex.Unlock()
+
+	fmt.Printf("Peer %s misbehaved: %s (score %d)\n", peerID, reason, score)
+
+	if banned {
+		banPeer(peerID, config.BanTime)
+	}
+}
+
+// Lower the misbehavior scores, so that only the peers misbehaving repeatedly get banned
+func decayScores() {
+	BanMutex.Lock()
+	defer BanMutex.Unlock()
+
+	for peerID, score := range Peer_Scores {
+		if score <= scoreDecay {
+			delete(Peer_Scores, peerID)
+		} else {
+			Peer_Scores[peerID] = score - scoreDecay
+		}
+	}
+}
+
+// Penalize a peer for a transaction the mempool rejected as invalid
+func penalizeRejection(peerID peer.ID, err error) {
+	var rejectErr *RejectError
+	if errors.As(err, &rejectErr) && rejectErr.Code == rejectInvalid {
+		misbehaving(peerID, penaltyInvalidTxn, "invalid transaction: "+rejectErr.Reason)
+	}
+}
+
+// Ban a peer for the duration, disconnecting it
+func banPeer(peerID peer.ID, duration time.Duration) {
+	until := time.Now().Add(duration)
+
+	BanMutex.Lock()
+	Ban_List[peerID.String()] = until
+	BanMutex.Unlock()
+
+	fmt.Println("Banned peer", peerID, "until", until.Format(time.RFC3339))
+
+	err := saveBanList()
+	if err != nil {
+		fmt.Println("Failed to save the ban list:", err)
+	}
+
+	disconnectPeer(peerID)
+}
+
+// Lift the ban of a peer, reporting whether it was banned
+func unbanPeer(peerID string) bool {
+	BanMutex.Lock()
+	_, exists := Ban_List[peerID]
+	delete(Ban_List, peerID)
+	BanMutex.Unlock()
+
+	if !exists {
+		return false
+	}
+
+	err := saveBanList()
+	if err != nil {
+		fmt.Println("Failed to save the ban list:", err)
+	}
+
+	return true
+}
+
+// Check whether the peer is banned, forgetting the bans that are over
+func isBanned(peerID peer.ID) bool {
+	BanMutex.Lock()
+	defer BanMutex.Unlock()
+
+	until, exists := Ban_List[peerID.String()]
+	if !exists {
+		return false
+	}
+
+	if time.Now().After(until) {
+		delete(Ban_List, peerID.String())
+		return false
+	}
+
+	return true
+}
+
+// Close the connections to a peer and forget it
+func disconnectPeer(peerID peer.ID) {
+	if User != nil {
+		User.Network().ClosePeer(peerID)
+	}
+
+	removePeer(peerID)
+}
+
+// Display the banned peers with the end of their ban
+func displayBanList() {
+	BanMutex.RLock()
+	defer BanMutex.RUnlock()
+
+	if len(Ban_List) == 0 {
+		fmt.Println("No banned peers")
+		return
+	}
+
+	for peerID, until := range Ban_List {
+		fmt.Printf("%s banned until %s\n", peerID, until.Format(time.RFC3339))
+	}
+}
+
+// Load the bans persisted by an earlier run, keeping those not over yet
+func loadBanList() error {
+	data, err := os.ReadFile(config.BanFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	bans := map[string]time.Time{}
+	err = json.Unmarshal(data, &bans)
+	if err != nil {
+		return fmt.Errorf("failed to parse the ban list: %v", err)
+	}
+
+	BanMutex.Lock()
+	defer BanMutex.Unlock()
+
+	for peerID, until := range bans {
+		if time.Now().Before(until) {
+			Ban_List[peerID] = until
+		}
+	}
+
+	return nil
+}
+
+// Persist the ban list
+func saveBanList() error {
+	BanMutex.RLock()
+	data, err := json.MarshalIndent(Ban_List, "", "  ")
+	BanMutex.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(config.BanFile, data, 0644)
+}
+
+// Connection gater refusing the connections of the banned peers
+type banGater struct{}
+
+func (banGater) InterceptPeerDial(peerID peer.ID) bool {
+	return !isBanned(peerID)
+}
+
+func (banGater) InterceptAddrDial(peerID peer.ID, _ multiaddr.Multiaddr) bool {
+	return !isBanned(peerID)
+}
+
+func (banGater) InterceptAccept(network.ConnMultiaddrs) bool {
+	return true
+}
+
+func (banGater) InterceptSecured(_ network.Direction, peerID peer.ID, _ network.ConnMultiaddrs) bool {
+	return !isBanned(peerID)
+}
+
+func (banGater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestMisbehaving(t *testing.T) {
+	resetState(t)
+	remote := remoteHost(t)
+	readyPeer(remote)
+
+	// Scores add up to the ban score
+	for i := 0; i < 4; i++ {
+		misbehaving(remote.ID(), penaltyMalformed, "malformed")
+	}
+	if isBanned(remote.ID()) || Peer_Scores[remote.ID().String()] != 4*penaltyMalformed {
+		t.Fatalf("banned at score %d", Peer_Scores[remote.ID().String()])
+	}
+
+	misbehaving(remote.ID(), penaltyMalformed, "malformed")
+	if !isBanned(remote.ID()) {
+		t.Fatal("peer not banned at the ban score")
+	}
+	if len(connectedPeers()) != 0 {
+		t.Error("banned peer kept as a neighbor")
+	}
+	if User.Network().Connectedness(remote.ID()) == network.Connected {
+		t.Error("banned peer still connected")
+	}
+	if _, exists := Peer_Scores[remote.ID().String()]; exists {
+		t.Error("score of the banned peer kept")
+	}
+
+	// The ban survives a restart, and the bans that are over are forgotten
+	Ban_List["expired"] = time.Now().Add(-time.Minute)
+	if err := saveBanList(); err != nil {
+		t.Fatal(err)
+	}
+	Ban_List = map[string]time.Time{}
+	if err := loadBanList(); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := Ban_List["expired"]; exists || !isBanned(remote.ID()) {
+		t.Errorf("ban list loaded as %v", Ban_List)
+	}
+
+	if !unbanPeer(remote.ID().String()) || isBanned(remote.ID()) {
+		t.Error("ban not lifted")
+	}
+	if unbanPeer(remote.ID().String()) {
+		t.Error("unbanned a peer that is not banned")
+	}
+}
+
+func TestPenalizeRejection(t *testing.T) {
+	resetState(t)
+	peerID := peer.ID("peer")
+
+	// A transaction spending unknown outputs may only be ahead of its parents
+	penalizeRejection(peerID, acceptToMempool(spendOutput("unknown", walletPubkey(), 0.5, 0.01)))
+	if score := Peer_Scores[peerID.String()]; score != 0 {
+		t.Errorf("score %d for a transaction with missing inputs", score)
+	}
+
+	forged := fundedSpend(t, "funding", 0.01)
+	forged.Inputs[0].Signature, _ = signTxn(&forged, newKey(t))
+	penalizeRejection(peerID, acceptToMempool(forged))
+	if score := Peer_Scores[peerID.String()]; score != penaltyInvalidTxn {
+		t.Errorf("score %d for an invalid transaction, want %d", score, penaltyInvalidTxn)
+	}
+}
+
+func TestBanGater(t *testing.T) {
+	resetState(t)
+	banned, other := peer.ID("banned"), peer.ID("other")
+	Ban_List[banned.String()] = time.Now().Add(time.Hour)
+
+	gater := banGater{}
+	if gater.InterceptPeerDial(banned) || gater.InterceptAddrDial(banned, nil) || gater.InterceptSecured(network.DirInbound, banned, nil) {
+		t.Error("connection with a banned peer allowed")
+	}
+	if !gater.InterceptPeerDial(other) || !gater.InterceptSecured(network.DirInbound, other, nil) {
+		t.Error("connection with a peer in good standing refused")
+	}
+}
+
+func TestDecayScores(t *testing.T) {
+	resetState(t)
+	Peer_Scores["low"], Peer_Scores["high"] = scoreDecay, 50
+
+	decayScores()
+
+	if _, exists := Peer_Scores["low"]; exists {
+		t.Error("decayed score kept at zero")
+	}
+	if score := Peer_Scores["high"]; score != 50-scoreDecay {
+		t.Errorf("score %d, want %d", score, 50-scoreDecay)
+	}
+}
+
+func TestRemovePeerForgetsScore(t *testing.T) {
+	resetState(t)
+	peerID := peer.ID(t.Name())
+
+	misbehaving(peerID, penaltyMalformed, "malformed")
+	removePeer(peerID)
+
+	if _, exists := Peer_Scores[peerID.String()]; exists {
+		t.Error("score kept after the peer disconnected")
+	}
+}
@@ -4,7 +4,12 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
+
+	work "blockchain-app/Work"
+
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 type Message struct {
@@ -14,21 +19,33 @@ type Message struct {
 }
 
 type UTXO struct {
-	Txn_id string  `json:"txn_id"`
-	Index  int32   `json:"index"`
-	Value  float64 `json:"value"`
-	Pubkey string  `json:"pub_key"`
+	Txn_id   string   `json:"txn_id"`
+	Index    int32    `json:"index"`
+	Value    float64  `json:"value"`
+	Pubkey   string   `json:"pub_key"`
+	Pubkeys  []string `json:"pub_keys,omitempty"` // Keys of a multisig UTXO
+	Required int32    `json:"required,omitempty"` // Signatures needed to spend a multisig UTXO
+
+	Height      int32 `json:"height"`                // Height of the block that created the UTXO
+	Lock_blocks int32 `json:"lock_blocks,omitempty"` // Blocks to wait after creation before spending
 }
 
 type Input struct {
-	Txn_id    string `json:"txn_id"`
-	Index     int32  `json:"index"`
-	Signature string `json:"sign"`
+	Txn_id     string   `json:"txn_id"`
+	Index      int32    `json:"index"`
+	Signature  string   `json:"sign"`
+	Signatures []string `json:"signs,omitempty"` // Multisig signatures, aligned with the pubkeys of the UTXO
 }
 
+// An output is either locked to a single Pubkey, or to Required of the Pubkeys (m-of-n)
 type Output struct {
-	Pubkey string  `json:"pub_key"`
-	Value  float64 `json:"amount"`
+	Pubkey   string   `json:"pub_key"`
+	Value    float64  `json:"amount"`
+	Pubkeys  []string `json:"pub_keys,omitempty"`
+	Required int32    `json:"required,omitempty"`
+
+	// Relative lock - blocks to wait after the output is confirmed before it can be spent
+	Lock_blocks int32 `json:"lock_blocks,omitempty"`
 }
 
 type Transaction struct {
@@ -40,6 +57,9 @@ type Transaction struct {
 	Inputs     []Input   `json:"inputs"`
 	Outputs    []Output  `json:"outputs"`
 	Timestamp  time.Time `json:"timestamp"`
+	Lock_time  int64     `json:"lock_time,omitempty"` // Block height or unix timestamp before which the transaction cannot be mined
+
+	Extra_nonce int32 `json:"extra_nonce,omitempty"` // Rolled in the coinbase when the block nonces run out
 }
 
 type Block struct {
@@ -51,6 +71,8 @@ type Block struct {
 	Merkle_hash   string        `json:"merkle_hash"` // Obtain the merkle root from the target node and send the list of transactions to build the local merkle tree
 	Timestamp     time.Time     `json:"timestamp"`
 	Transactions  []Transaction `json:"transactions"`
+	Sealer        string        `json:"sealer,omitempty"`    // Authority that sealed the block (proof-of-authority)
+	Signature     string        `json:"signature,omitempty"` // Sealer's signature over the block hash
 }
 
 type BlockDTO struct {
@@ -62,6 +84,71 @@ type BlockDTO struct {
 	Merkle_hash   string    `json:"merkle_hash"`
 	Timestamp     time.Time `json:"timestamp"`
 	Transactions  []string  `json:"transactions"`
+	Sealer        string    `json:"sealer,omitempty"`
+	Signature     string    `json:"signature,omitempty"`
+}
+
+// Connected peer with what is known of it
+type PeerEntry struct {
+	Info      peer.AddrInfo
+	Inbound   bool      // The peer opened the connection
+	Connected time.Time // Time the connection opened
+	Last_seen time.Time // Last stream or message from the peer
+	Ready     bool      // The peer completed the handshake
+	Handshake Handshake // Sent by the peer after connecting
+	Height    int32     // Best height known of the peer
+	Tip       string    // Hash of the block at that height
+	Group     string    // Network group of the address, for the diversity of the peers
+	Useful    int       // Valid transactions and blocks the peer relayed first
+	Protected bool      // Holds one of the outbound slots protected from trimming
+}
+
+// Exchanged right after connecting, to check both nodes are on the same chain
+type Handshake struct {
+	Version    int    `json:"version"`
+	Genesis    string `json:"genesis"`
+	Height     int32  `json:"height"`
+	Tip        string `json:"tip"`
+	Services   uint64 `json:"services"`
+	User_agent string `json:"user_agent"`
+}
+
+// Block without its transactions, synced before the bodies
+type BlockHeader struct {
+	Block_hash    string    `json:"block_hash"`
+	Block_height  int32     `json:"block_height"`
+	Previous_hash string    `json:"previous_hash"`
+	Nonce         int32     `json:"nonce"`
+	Difficulty    int32     `json:"difficulty"`
+	Merkle_hash   string    `json:"merkle_hash"`
+	Timestamp     time.Time `json:"timestamp"`
+	Sealer        string    `json:"sealer,omitempty"`
+	Signature     string    `json:"signature,omitempty"`
+}
+
+// Request for a block by hash, or a range of main chain blocks starting at a hash or a height
+type BlockRequest struct {
+	Hash   string `json:"hash,omitempty"`
+	Height int32  `json:"height,omitempty"`
+	Count  int32  `json:"count,omitempty"` // Blocks in the range, one if unset
+}
+
+// Transaction sent by a peer, with the proof of its inclusion in a block once confirmed
+type TransactionProof struct {
+	Transaction  Transaction `json:"transaction"`
+	Confirmed    bool        `json:"confirmed"`
+	Block_hash   string      `json:"block_hash,omitempty"`
+	Block_height int32       `json:"block_height,omitempty"`
+	Index        int         `json:"index,omitempty"`  // Position of the transaction in the block
+	Branch       []string    `json:"branch,omitempty"` // Merkle siblings from the leaf up to the root
+}
+
+// Bookkeeping of a mempool transaction
+type MempoolEntry struct {
+	Time     time.Time // Arrival in the mempool
+	Size     int       // Serialized size in bytes
+	Fee_rate float64   // Fee per kilobyte
+	Height   int32     // Height of the next block on arrival
 }
 
 type MerkleNode struct {
@@ -83,10 +170,27 @@ func (txn *Transaction) generateTxn() {
 
 	for _, output := range txn.Outputs {
 		data += fmt.Sprintf("%.8f", output.Value) + output.Pubkey
+
+		if output.Required > 0 {
+			data += strconv.Itoa(int(output.Required)) + strings.Join(output.Pubkeys, ",")
+		}
+
+		if output.Lock_blocks > 0 {
+			data += "+" + strconv.Itoa(int(output.Lock_blocks))
+		}
 	}
 
 	data += fmt.Sprintf("%.8f", txn.Fee)
-	data += txn.Timestamp.String()
+	// Formatted in UTC so that the ID survives the JSON round trip
+	data += txn.Timestamp.UTC().Format(time.RFC3339Nano)
+
+	if txn.Lock_time != 0 {
+		data += strconv.FormatInt(txn.Lock_time, 10)
+	}
+
+	if txn.Extra_nonce != 0 {
+		data += "#" + strconv.Itoa(int(txn.Extra_nonce))
+	}
 
 	hash := sha256.Sum256([]byte(data))
 
@@ -94,15 +198,54 @@ func (txn *Transaction) generateTxn() {
 }
 
 func (block *Block) generateBlockHash() {
-	var data string
+	prefix, suffix := block.headerParts()
 
-	data += block.Previous_hash
-	data += block.Merkle_hash
-	data += strconv.Itoa(int(block.Nonce))
-	data += block.Timestamp.String()
-	data += strconv.Itoa(int(block.Block_height))
-	data += strconv.Itoa(int(block.Difficulty))
+	block.Block_hash = hashHeader(prefix, block.Nonce, suffix)
+}
 
-	hash := sha256.Sum256([]byte(data))
-	block.Block_hash = fmt.Sprintf("%x", hash)
+func (block *Block) header() BlockHeader {
+	return BlockHeader{
+		Block_hash:    block.Block_hash,
+		Block_height:  block.Block_height,
+		Previous_hash: block.Previous_hash,
+		Nonce:         block.Nonce,
+		Difficulty:    block.Difficulty,
+		Merkle_hash:   block.Merkle_hash,
+		Timestamp:     block.Timestamp,
+		Sealer:        block.Sealer,
+		Signature:     block.Signature,
+	}
+}
+
+// Block of the header, without the transactions
+func (header *BlockHeader) toBlock() Block {
+	return Block{
+		Block_hash:    header.Block_hash,
+		Block_height:  header.Block_height,
+		Previous_hash: header.Previous_hash,
+		Nonce:         header.Nonce,
+		Difficulty:    header.Difficulty,
+		Merkle_hash:   header.Merkle_hash,
+		Timestamp:     header.Timestamp,
+		Sealer:        header.Sealer,
+		Signature:     header.Signature,
+	}
+}
+
+// The header data hashed before and after the nonce
+func (block *Block) headerParts() (string, string) {
+	prefix := block.Previous_hash + block.Merkle_hash
+
+	var suffix string
+	suffix += block.Timestamp.UTC().Format(time.RFC3339Nano)
+	suffix += strconv.Itoa(int(block.Block_height))
+	suffix += strconv.Itoa(int(block.Difficulty))
+	suffix += block.Sealer
+
+	return prefix, suffix
+}
+
+// Hash of the header data with the nonce
+func hashHeader(prefix string, nonce int32, suffix string) string {
+	return work.HashHeader(prefix, nonce, suffix)
 }
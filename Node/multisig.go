@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+const (
+	maxPartialTxns = 100            // Most partial transactions kept for the co-signers
+	partialExpiry  = 24 * time.Hour // Age after which an incomplete partial transaction is dropped
+)
+
+// Check whether the public key is one of the owners of the UTXO
+func canSign(utxo UTXO, pubKeyHex string) bool {
+	if utxo.Required == 0 {
+		return utxo.Pubkey == pubKeyHex
+	}
+
+	for _, key := range utxo.Pubkeys {
+		if key == pubKeyHex {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Sign every input of the transaction the key owns, leaving the rest for the co-signers
+func signInputs(txn *Transaction, privKey crypto.PrivKey) error {
+	pubKeyBytes, _ := privKey.GetPublic().Raw()
+	pubKeyHex := hex.EncodeToString(pubKeyBytes)
+
+	for idx, input := range txn.Inputs {
+		utxo, exists := findUTXO(input.Txn_id, input.Index)
+
+		if !exists {
+			return fmt.Errorf("input %s:%d does not exist in the UTXO set", input.Txn_id, input.Index)
+		}
+
+		if !canSign(utxo, pubKeyHex) {
+			continue
+		}
+
+		signature, err := signTxn(txn, privKey)
+		if err != nil {
+			return fmt.Errorf("failed to sign input %d: %v", idx, err)
+		}
+
+		// Single key UTXO
+		if utxo.Required == 0 {
+			txn.Inputs[idx].Signature = signature
+			continue
+		}
+
+		// Multisig UTXO - the signature goes in the slot of the key
+		if len(txn.Inputs[idx].Signatures) != len(utxo.Pubkeys) {
+			signatures := make([]string, len(utxo.Pubkeys))
+			copy(signatures, txn.Inputs[idx].Signatures)
+			txn.Inputs[idx].Signatures = signatures
+		}
+
+		for keyIdx, key := range utxo.Pubkeys {
+			if key == pubKeyHex {
+				txn.Inputs[idx].Signatures[keyIdx] = signature
+			}
+		}
+	}
+
+	return nil
+}
+
+// Verify the signatures of an input against the UTXO it spends
+func verifyInput(txn *Transaction, utxo UTXO, input Input) error {
+	if utxo.Required == 0 {
+		return verifyTxnSignature(txn, utxo.Pubkey, input.Signature)
+	}
+
+	if len(input.Signatures) > len(utxo.Pubkeys) {
+		return fmt.Errorf("more signatures than keys")
+	}
+
+	valid := int32(0)
+	for idx, signature := range input.Signatures {
+		if signature == "" {
+			continue
+		}
+
+		err := verifyTxnSignature(txn, utxo.Pubkeys[idx], signature)
+		if err != nil {
+			return fmt.Errorf("signature %d: %v", idx, err)
+		}
+		valid++
+	}
+
+	if valid < utxo.Required {
+		return fmt.Errorf("only %d of the %d required signatures", valid, utxo.Required)
+	}
+
+	return nil
+}
+
+// Check whether the key owns one of the inputs of the transaction
+func canCosign(txn *Transaction, pubKeyHex string) bool {
+	for _, input := range txn.Inputs {
+		utxo, exists := findUTXO(input.Txn_id, input.Index)
+
+		if exists && canSign(utxo, pubKeyHex) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Count the valid signatures collected on the inputs of the transaction
+func countSignatures(txn *Transaction) int {
+	count := 0
+
+	for _, input := range txn.Inputs {
+		if input.Signature != "" {
+			count++
+		}
+
+		for _, signature := range input.Signatures {
+			if signature != "" {
+				count++
+			}
+		}
+	}
+
+	return count
+}
+
+// Drop the partial transactions older than the expiry - the caller holds PartialMutex
+func expirePartialTxns(now time.Time) {
+	for txnID, arrival := range Partial_Times {
+		if now.Sub(arrival) > partialExpiry {
+			delete(Partial_Txns, txnID)
+			delete(Partial_Times, txnID)
+		}
+	}
+}
+
+// Keep a partial transaction for the co-signers - the caller holds PartialMutex
+func storePartialTxn(txn Transaction) {
+	if _, exists := Partial_Times[txn.Txn_id]; !exists {
+		Partial_Times[txn.Txn_id] = time.Now()
+	}
+	Partial_Txns[txn.Txn_id] = txn
+}
+
+// Forget a partial transaction - the caller holds PartialMutex
+func deletePartialTxn(txnID string) {
+	delete(Partial_Txns, txnID)
+	delete(Partial_Times, txnID)
+}
+
+// Count the signatures the transaction still needs
+func missingSignatures(txn *Transaction) int {
+	missing := 0
+
+	for _, input := range txn.Inputs {
+		utxo, exists := findUTXO(input.Txn_id, input.Index)
+
+		if !exists {
+			continue
+		}
+
+		if utxo.Required == 0 {
+			if input.Signature == "" {
+				missing++
+			}
+			continue
+		}
+
+		signed := 0
+		for _, signature := range input.Signatures {
+			if signature != "" {
+				signed++
+			}
+		}
+
+		if signed < int(utxo.Required) {
+			missing += int(utxo.Required) - signed
+		}
+	}
+
+	return missing
+}
+
+// Copy the valid signatures of a co-signer's copy into the local partial transaction
+func mergeSignatures(local *Transaction, remote Transaction) error {
+	if local.Txn_id != remote.Txn_id || len(local.Inputs) != len(remote.Inputs) {
+		return fmt.Errorf("partial transactions do not match")
+	}
+
+	for idx, input := range remote.Inputs {
+		utxo, exists := findUTXO(input.Txn_id, input.Index)
+
+		if !exists {
+			return fmt.Errorf("input %s:%d does not exist in the UTXO set", input.Txn_id, input.Index)
+		}
+
+		if utxo.Required == 0 {
+			if input.Signature != "" && verifyTxnSignature(local, utxo.Pubkey, input.Signature) == nil {
+				local.Inputs[idx].Signature = input.Signature
+			}
+			continue
+		}
+
+		if len(local.Inputs[idx].Signatures) != len(utxo.Pubkeys) {
+			signatures := make([]string, len(utxo.Pubkeys))
+			copy(signatures, local.Inputs[idx].Signatures)
+			local.Inputs[idx].Signatures = signatures
+		}
+
+		for keyIdx, signature := range input.Signatures {
+			if keyIdx >= len(utxo.Pubkeys) || signature == "" {
+				continue
+			}
+
+			// Ignore the signatures that do not verify
+			if verifyTxnSignature(local, utxo.Pubkeys[keyIdx], signature) == nil {
+				local.Inputs[idx].Signatures[keyIdx] = signature
+			}
+		}
+	}
+
+	return nil
+}
+
+// Sign a partial transaction with the wallet key, and submit it once all the signatures are collected
+func signPartialTxn(txnID string) (int, error) {
+	PartialMutex.Lock()
+	defer PartialMutex.Unlock()
+
+	transaction, exists := Partial_Txns[txnID]
+	if !exists {
+		return 0, fmt.Errorf("partial transaction %s not found", txnID)
+	}
+
+	err := signInputs(&transaction, Wallet_Key)
+	if err != nil {
+		return 0, err
+	}
+	storePartialTxn(transaction)
+
+	missing := missingSignatures(&transaction)
+	if missing > 0 {
+		return missing, nil
+	}
+
+	err = submitTransaction(&transaction)
+	if err != nil {
+		return 0, err
+	}
+
+	deletePartialTxn(txnID)
+	return 0, nil
+}
+
+// Send a partial transaction to a co-signer
+func sendPartialTxn(nodeID string, txnID string) error {
+	PartialMutex.RLock()
+	transaction, exists := Partial_Txns[txnID]
+	PartialMutex.RUnlock()
+
+	if !exists {
+		return fmt.Errorf("partial transaction %s not found", txnID)
+	}
+
+	target, exists := lookupPeer(nodeID)
+
+	if !exists {
+		return fmt.Errorf("co-signer %s is not connected", nodeID)
+	}
+
+	stream, wire, err := openStream(context.Background(), target.Info.ID, "/multisig/sign")
+	if err != nil {
+		return fmt.Errorf("failed to create stream with co-signer: %v", err)
+	}
+	defer stream.Close()
+
+	err = wire.Write(msgTransaction, transaction)
+	if err != nil {
+		return fmt.Errorf("failed to send transaction to co-signer: %v", err)
+	}
+
+	return wire.Flush()
+}
+
+// Receive a partial transaction from a co-signer and merge its signatures
+func receivePartialTxn(wire *Wire, strm network.Stream) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("Recovered from panic in receivePartialTxn:", r)
+		}
+	}()
+
+	for {
+		var transaction Transaction
+		err := wire.Read(msgTransaction, &transaction)
+		if errors.Is(err, errBadMessage) {
+			misbehaving(strm.Conn().RemotePeer(), penaltyMalformed, err.Error())
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		// The ID must commit to the contents of the transaction
+		expected := transaction
+		expected.generateTxn()
+		if expected.Txn_id != transaction.Txn_id {
+			misbehaving(strm.Conn().RemotePeer(), penaltyInvalidTxn, "partial transaction id does not match its contents")
+			continue
+		}
+
+		// Only the transactions the wallet can co-sign are kept
+		if !canCosign(&transaction, walletPubkey()) {
+			fmt.Println("Ignored partial transaction", transaction.Txn_id, "- the wallet owns none of its inputs")
+			continue
+		}
+
+		PartialMutex.Lock()
+		expirePartialTxns(time.Now())
+		local, exists := Partial_Txns[transaction.Txn_id]
+		if !exists {
+			if len(Partial_Txns) >= maxPartialTxns {
+				PartialMutex.Unlock()
+				fmt.Println("Ignored partial transaction", transaction.Txn_id, "- too many partial transactions pending")
+				continue
+			}
+
+			// Start from an unsigned copy so that only verified signatures are kept
+			local = transaction
+			local.Inputs = make([]Input, len(transaction.Inputs))
+			for idx, input := range transaction.Inputs {
+				local.Inputs[idx] = Input{Txn_id: input.Txn_id, Index: input.Index}
+			}
+		}
+
+		err = mergeSignatures(&local, transaction)
+		if err != nil {
+			PartialMutex.Unlock()
+			misbehaving(strm.Conn().RemotePeer(), penaltyInvalidTxn, "invalid partial transaction: "+err.Error())
+			continue
+		}
+
+		// A new partial transaction must carry the signature of a co-signer
+		if !exists && countSignatures(&local) == 0 {
+			PartialMutex.Unlock()
+			fmt.Println("Ignored partial transaction", transaction.Txn_id, "- it carries no valid signature")
+			continue
+		}
+		storePartialTxn(local)
+		PartialMutex.Unlock()
+
+		missing := missingSignatures(&local)
+		fmt.Printf("\x1b[32m> Partial Txn Received\n> Txn_id: %s\n> Missing signatures: %d\n> Sent from %s\x1b[0m\n", local.Txn_id, missing, strm.Conn().RemotePeer())
+
+		// The last co-signer broadcasts the transaction
+		if missing == 0 {
+			err = submitTransaction(&local)
+			if err != nil {
+				fmt.Println("Failed to submit transaction:", err)
+				continue
+			}
+
+			PartialMutex.Lock()
+			deletePartialTxn(local.Txn_id)
+			PartialMutex.Unlock()
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// Spend of the output at index 0 of the transaction, paying the value to the key
+func spendOutput(txnID string, pubkey string, value float64, fee float64) Transaction {
+	txn := Transaction{
+		In_sz:     1,
+		Out_sz:    1,
+		Fee:       fee,
+		Inputs:    []Input{{Txn_id: txnID, Index: 0}},
+		Outputs:   []Output{{Pubkey: pubkey, Value: value}},
+		Timestamp: time.Now(),
+	}
+	txn.generateTxn()
+	return txn
+}
+
+func TestValidateOutput(t *testing.T) {
+	first, second := pubkeyHex(newKey(t)), pubkeyHex(newKey(t))
+
+	tests := []struct {
+		name   string
+		output Output
+		valid  bool
+	}{
+		{"single key", Output{Pubkey: first, Value: 1}, true},
+		{"negative value", Output{Pubkey: first, Value: -1}, false},
+		{"key that is not a public key", Output{Pubkey: "peer id", Value: 1}, false},
+		{"two of two", Output{Pubkeys: []string{first, second}, Required: 2, Value: 1}, true},
+		{"more required than keys", Output{Pubkeys: []string{first, second}, Required: 3, Value: 1}, false},
+		{"keys without a required count", Output{Pubkeys: []string{first, second}, Value: 1}, false},
+		{"single key and multisig keys", Output{Pubkey: first, Pubkeys: []string{first, second}, Required: 1, Value: 1}, false},
+		{"duplicate key", Output{Pubkeys: []string{first, first}, Required: 2, Value: 1}, false},
+	}
+
+	for _, test := range tests {
+		if err := validateOutput(test.output); (err == nil) != test.valid {
+			t.Errorf("%s: valid = %v, want %v (%v)", test.name, err == nil, test.valid, err)
+		}
+	}
+}
+
+func TestVerifyInputMultisig(t *testing.T) {
+	keys := []crypto.PrivKey{newKey(t), newKey(t), newKey(t)}
+	outsider := newKey(t)
+
+	utxo := UTXO{Txn_id: "funding", Value: 10, Required: 2}
+	for _, key := range keys {
+		utxo.Pubkeys = append(utxo.Pubkeys, pubkeyHex(key))
+	}
+	txn := spendOutput("funding", pubkeyHex(keys[0]), 9, 1)
+
+	tests := []struct {
+		name    string
+		signers []crypto.PrivKey // Key signing each slot, nil leaves it empty
+		valid   bool
+	}{
+		{"two of three", []crypto.PrivKey{keys[0], nil, keys[2]}, true},
+		{"all three", []crypto.PrivKey{keys[0], keys[1], keys[2]}, true},
+		{"one of three", []crypto.PrivKey{nil, keys[1], nil}, false},
+		{"no signature", []crypto.PrivKey{}, false},
+		{"key in the wrong slot", []crypto.PrivKey{keys[1], keys[0], nil}, false},
+		{"outsider key", []crypto.PrivKey{keys[0], outsider, nil}, false},
+		{"more signatures than keys", []crypto.PrivKey{keys[0], keys[1], keys[2], keys[0]}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := txn.Inputs[0]
+			input.Signatures = make([]string, len(test.signers))
+			for idx, key := range test.signers {
+				if key == nil {
+					continue
+				}
+				signature, err := signTxn(&txn, key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				input.Signatures[idx] = signature
+			}
+
+			err := verifyInput(&txn, utxo, input)
+			if (err == nil) != test.valid {
+				t.Fatalf("valid = %v, want %v (%v)", err == nil, test.valid, err)
+			}
+		})
+	}
+}
+
+// A 2-of-2 spend parked by sendFunds, completed by the co-signer, and valid once merged
+func TestCosignPartialTransaction(t *testing.T) {
+	resetState(t)
+	cosigner := newKey(t)
+
+	UTXO_SET[utxoKey("treasury", 0)] = UTXO{Txn_id: "treasury", Value: 10, Required: 2, Pubkeys: []string{walletPubkey(), pubkeyHex(cosigner)}}
+
+	txnID, err := sendFunds([]string{utxoKey("treasury", 0)}, []Output{{Pubkey: pubkeyHex(cosigner), Value: 9}}, 1, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	partial, exists := Partial_Txns[txnID]
+	if !exists {
+		t.Fatal("transaction missing a signature not kept as partial")
+	}
+	if missing := missingSignatures(&partial); missing != 1 {
+		t.Fatalf("missing = %d after the wallet signed, want 1", missing)
+	}
+	if err := validateTransaction(partial, 1, time.Now(), newUTXOView()); err == nil {
+		t.Fatal("partial transaction validated with one of two signatures")
+	}
+
+	// The co-signer signs its own copy, and only its verified signatures are merged back
+	remote := partial
+	remote.Inputs = []Input{{Txn_id: "treasury", Index: 0}}
+	if err := signInputs(&remote, cosigner); err != nil {
+		t.Fatal(err)
+	}
+	remote.Inputs[0].Signatures[0] = "00"
+
+	if err := mergeSignatures(&partial, remote); err != nil {
+		t.Fatal(err)
+	}
+	if missing := missingSignatures(&partial); missing != 0 {
+		t.Fatalf("missing = %d after merging, want 0", missing)
+	}
+	if err := validateTransaction(partial, 1, time.Now(), newUTXOView()); err != nil {
+		t.Errorf("fully signed transaction rejected: %v", err)
+	}
+}
+
+func TestCanCosign(t *testing.T) {
+	resetState(t)
+	other := pubkeyHex(newKey(t))
+
+	UTXO_SET[utxoKey("mine", 0)] = UTXO{Txn_id: "mine", Value: 1, Pubkey: walletPubkey()}
+	UTXO_SET[utxoKey("shared", 0)] = UTXO{Txn_id: "shared", Value: 1, Required: 1, Pubkeys: []string{other, walletPubkey()}}
+	UTXO_SET[utxoKey("theirs", 0)] = UTXO{Txn_id: "theirs", Value: 1, Pubkey: other}
+
+	tests := []struct {
+		name   string
+		inputs []string
+		want   bool
+	}{
+		{"single key input", []string{"mine"}, true},
+		{"multisig input", []string{"shared"}, true},
+		{"foreign input", []string{"theirs"}, false},
+		{"unknown input", []string{"missing"}, false},
+		{"one owned input", []string{"theirs", "shared"}, true},
+	}
+
+	for _, test := range tests {
+		txn := Transaction{}
+		for _, txnID := range test.inputs {
+			txn.Inputs = append(txn.Inputs, Input{Txn_id: txnID, Index: 0})
+		}
+		if got := canCosign(&txn, walletPubkey()); got != test.want {
+			t.Errorf("%s: can cosign = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestExpirePartialTxns(t *testing.T) {
+	resetState(t)
+	now := time.Now()
+
+	Partial_Txns["old"] = Transaction{Txn_id: "old"}
+	Partial_Times["old"] = now.Add(-partialExpiry - time.Minute)
+	Partial_Txns["new"] = Transaction{Txn_id: "new"}
+	Partial_Times["new"] = now.Add(-time.Minute)
+
+	expirePartialTxns(now)
+
+	if _, exists := Partial_Txns["old"]; exists {
+		t.Error("expired partial transaction kept")
+	}
+	if _, exists := Partial_Txns["new"]; !exists {
+		t.Error("recent partial transaction dropped")
+	}
+}
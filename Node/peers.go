@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Keep the peer table up to date as the connections open and close
+func trackPeers() {
+	User.Network().Notify(&network.NotifyBundle{
+		ConnectedF:    peerConnected,
+		DisconnectedF: peerDisconnected,
+	})
+}
+
+func peerConnected(_ network.Network, conn network.Conn) {
+	peerID := conn.RemotePeer()
+	now := time.Now()
+
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+
+	if _, exists := peerTable[peerID.String()]; exists {
+		return
+	}
+
+	entry := &PeerEntry{
+		Info:      peer.AddrInfo{ID: peerID, Addrs: User.Peerstore().Addrs(peerID)},
+		Inbound:   conn.Stat().Direction == network.DirInbound,
+		Connected: now,
+		Last_seen: now,
+		Group:     netGroup(conn.RemoteMultiaddr()),
+	}
+	peerTable[peerID.String()] = entry
+
+	// An inbound peer has to complete the handshake in time, or give its connection back
+	if entry.Inbound {
+		time.AfterFunc(handshakeTimeout, func() { expireHandshake(peerID) })
+	}
+}
+
+// Disconnect a peer still not done with the handshake, reporting whether it was
+func expireHandshake(peerID peer.ID) bool {
+	peerMutex.RLock()
+	entry, exists := peerTable[peerID.String()]
+	pending := exists && !entry.Ready
+	peerMutex.RUnlock()
+
+	if !pending {
+		return false
+	}
+
+	fmt.Println("Peer", peerID, "did not complete the handshake in time")
+	disconnectPeer(peerID)
+	return true
+}
+
+func peerDisconnected(net network.Network, conn network.Conn) {
+	// The peer may still be reachable over another connection
+	if net.Connectedness(conn.RemotePeer()) == network.Connected {
+		return
+	}
+
+	removePeer(conn.RemotePeer())
+}
+
+// Forget a peer that is no longer connected
+func removePeer(peerID peer.ID) {
+	peerMutex.Lock()
+	delete(peerTable, peerID.String())
+	protectOutbound()
+	peerMutex.Unlock()
+
+	BanMutex.Lock()
+	delete(Peer_Scores, peerID.String())
+	BanMutex.Unlock()
+
+	forgetStreams(peerID)
+
+	if User != nil {
+		User.ConnManager().Unprotect(peerID, protectOutboundTag)
+		User.ConnManager().Unprotect(peerID, protectLongLivedTag)
+		User.ConnManager().Unprotect(peerID, protectDiverseTag)
+	}
+}
+
+// Peers that completed the handshake, in no particular order
+func connectedPeers() []peer.AddrInfo {
+	peerMutex.RLock()
+	defer peerMutex.RUnlock()
+
+	peers := make([]peer.AddrInfo, 0, len(peerTable))
+	for _, entry := range peerTable {
+		if entry.Ready {
+			peers = append(peers, entry.Info)
+		}
+	}
+
+	return peers
+}
+
+// Find a peer that completed the handshake by its ID
+func lookupPeer(peerID string) (PeerEntry, bool) {
+	peerMutex.RLock()
+	defer peerMutex.RUnlock()
+
+	entry, exists := peerTable[peerID]
+	if !exists || !entry.Ready {
+		return PeerEntry{}, false
+	}
+
+	return *entry, true
+}
+
+// Record the handshake of a compatible peer, making it available to the relay and the sync
+func recordHandshake(peerID peer.ID, remote Handshake) {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+
+	entry, exists := peerTable[peerID.String()]
+	if !exists {
+		return
+	}
+
+	entry.Handshake = remote
+	entry.Height = remote.Height
+	entry.Tip = remote.Tip
+	entry.Ready = true
+	entry.Last_seen = time.Now()
+
+	protectOutbound()
+}
+
+// Protect the outbound peers, up to the outbound slots, so the inbound peers cannot take all the connections.
+// The peers connected the longest get the free slots. The caller holds peerMutex.
+func protectOutbound() {
+	protected := 0
+	candidates := []*PeerEntry{}
+	for _, entry := range peerTable {
+		if entry.Protected {
+			protected++
+		} else if entry.Ready && !entry.Inbound {
+			candidates = append(candidates, entry)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Connected.Before(candidates[j].Connected)
+	})
+
+	for _, entry := range candidates[:min(max(config.OutboundSlots-protected, 0), len(candidates))] {
+		entry.Protected = true
+		if User != nil {
+			User.ConnManager().Protect(entry.Info.ID, protectOutboundTag)
+		}
+	}
+}
+
+// Note that the peer was heard from
+func touchPeer(peerID peer.ID) {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+
+	if entry, exists := peerTable[peerID.String()]; exists {
+		entry.Last_seen = time.Now()
+	}
+}
+
+// Raise the best height known of a peer after it sent a block
+func updatePeerTip(peerID peer.ID, height int32, hash string) {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+
+	if entry, exists := peerTable[peerID.String()]; exists && height > entry.Height {
+		entry.Height = height
+		entry.Tip = hash
+	}
+}
+
+// Display the peer table
+func displayPeers() {
+	peerMutex.RLock()
+	defer peerMutex.RUnlock()
+
+	if len(peerTable) == 0 {
+		fmt.Println("No connected peers")
+		return
+	}
+
+	for peerID, entry := range peerTable {
+		direction := "outbound"
+		if entry.Inbound {
+			direction = "inbound"
+		}
+
+		if !entry.Ready {
+			fmt.Printf("%s (%s): waiting for the handshake\n", peerID, direction)
+			continue
+		}
+
+		fmt.Printf("%s (%s): %s, height %d, connected %s ago, last seen %s ago, %d useful item(s)\n",
+			peerID, direction, entry.Handshake.User_agent, entry.Height,
+			time.Since(entry.Connected).Round(time.Second), time.Since(entry.Last_seen).Round(time.Second), entry.Useful)
+	}
+}
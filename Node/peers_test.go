@@ -0,0 +1,152 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Count a connected host as a neighbor that completed the handshake
+func readyPeer(remote host.Host) {
+	peerMutex.Lock()
+	defer peerMutex.Unlock()
+
+	peerTable[remote.ID().String()] = &PeerEntry{
+		Info:      peer.AddrInfo{ID: remote.ID(), Addrs: remote.Addrs()},
+		Connected: time.Now(),
+		Last_seen: time.Now(),
+		Ready:     true,
+	}
+}
+
+// Wait for the connection notifications to reach the peer table
+func waitPeer(t *testing.T, peerID peer.ID, tracked bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		peerMutex.RLock()
+		_, exists := peerTable[peerID.String()]
+		peerMutex.RUnlock()
+
+		if exists == tracked {
+			return
+		}
+	}
+	t.Fatalf("peer %s tracked = %v, want %v", peerID, !tracked, tracked)
+}
+
+// Add a peer to the peer table, connected the given time ago
+func addPeer(name string, inbound bool, ready bool, age time.Duration) peer.ID {
+	peerID := peer.ID(name)
+	peerTable[peerID.String()] = &PeerEntry{
+		Info:      peer.AddrInfo{ID: peerID},
+		Inbound:   inbound,
+		Ready:     ready,
+		Connected: time.Now().Add(-age),
+	}
+	return peerID
+}
+
+func TestTrackPeers(t *testing.T) {
+	resetState(t)
+	remote := remoteHost(t)
+	waitPeer(t, remote.ID(), true)
+
+	// Known, but not relayed to before the handshake
+	if len(connectedPeers()) != 0 {
+		t.Error("peer relayed to before the handshake")
+	}
+	if _, ready := lookupPeer(remote.ID().String()); ready {
+		t.Error("peer ready before the handshake")
+	}
+
+	recordHandshake(remote.ID(), Handshake{Genesis: Genesis_Block, Height: 5, Tip: "five"})
+	if peers := connectedPeers(); len(peers) != 1 || peers[0].ID != remote.ID() {
+		t.Errorf("connected peers %v after the handshake", peers)
+	}
+
+	// Only a better block raises the height known of the peer
+	updatePeerTip(remote.ID(), 7, "seven")
+	updatePeerTip(remote.ID(), 6, "six")
+	if entry, _ := lookupPeer(remote.ID().String()); entry.Height != 7 || entry.Tip != "seven" {
+		t.Errorf("peer at height %d, tip %s, want 7 and seven", entry.Height, entry.Tip)
+	}
+
+	User.Network().ClosePeer(remote.ID())
+	waitPeer(t, remote.ID(), false)
+	if User.Network().Connectedness(remote.ID()) == network.Connected {
+		t.Error("peer still connected")
+	}
+}
+
+func TestProtectOutbound(t *testing.T) {
+	resetState(t)
+	config.OutboundSlots = 2
+
+	oldest := addPeer("oldest", false, true, 3*time.Hour)
+	older := addPeer("older", false, true, 2*time.Hour)
+	newest := addPeer("newest", false, true, time.Hour)
+	inbound := addPeer("inbound", true, true, 4*time.Hour)
+	pending := addPeer("pending", false, false, 5*time.Hour)
+
+	peerMutex.Lock()
+	protectOutbound()
+	peerMutex.Unlock()
+
+	tests := []struct {
+		name      string
+		peerID    peer.ID
+		protected bool
+	}{
+		{"oldest outbound", oldest, true},
+		{"older outbound", older, true},
+		{"outbound beyond the slots", newest, false},
+		{"inbound", inbound, false},
+		{"outbound without a handshake", pending, false},
+	}
+
+	for _, test := range tests {
+		if protected := peerTable[test.peerID.String()].Protected; protected != test.protected {
+			t.Errorf("%s: protected = %v, want %v", test.name, protected, test.protected)
+		}
+	}
+
+	// A freed slot goes to the next outbound peer
+	removePeer(oldest)
+	if !peerTable[newest.String()].Protected {
+		t.Error("free outbound slot not given to the remaining outbound peer")
+	}
+}
+
+func TestExpireHandshake(t *testing.T) {
+	tests := []struct {
+		name         string
+		ready        bool
+		disconnected bool
+	}{
+		{"handshake pending", false, true},
+		{"handshake done", true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetState(t)
+			peerID := addPeer(test.name, true, test.ready, handshakeTimeout)
+
+			if disconnected := expireHandshake(peerID); disconnected != test.disconnected {
+				t.Errorf("disconnected = %v, want %v", disconnected, test.disconnected)
+			}
+			if _, kept := peerTable[peerID.String()]; kept == test.disconnected {
+				t.Errorf("peer kept = %v after the handshake timeout", kept)
+			}
+		})
+	}
+
+	// A peer already gone is left alone
+	if expireHandshake(peer.ID("gone")) {
+		t.Error("unknown peer disconnected")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Proof-of-authority engine - the authorities take turns, in order, to sign the blocks
+type PoaEngine struct {
+	Authorities []peer.ID
+	Key         crypto.PrivKey // Signing key of this node
+	Self        peer.ID
+}
+
+func (engine *PoaEngine) Name() string {
+	return "poa"
+}
+
+// Authority whose turn it is to seal the block at the height
+func (engine *PoaEngine) inTurn(height int32) peer.ID {
+	return engine.Authorities[int(height)%len(engine.Authorities)]
+}
+
+func (engine *PoaEngine) Prepare(block *Block) error {
+	if sealer := engine.inTurn(block.Block_height); sealer != engine.Self {
+		return fmt.Errorf("block %d is sealed by %s, not this node", block.Block_height, sealer)
+	}
+
+	block.Difficulty = 0
+	block.Sealer = engine.Self.String()
+	return nil
+}
+
+// Sign the block hash with the node key
+func (engine *PoaEngine) Seal(ctx context.Context, block *Block) error {
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("sealing interrupted")
+	default:
+	}
+
+	block.generateBlockHash()
+
+	signature, err := engine.Key.Sign([]byte(block.Block_hash))
+	if err != nil {
+		return fmt.Errorf("failed to sign block: %v", err)
+	}
+
+	block.Signature = hex.EncodeToString(signature)
+	return nil
+}
+
+func (engine *PoaEngine) VerifySeal(block Block) error {
+	// The genesis block is not sealed
+	if block.Block_height == 0 {
+		return nil
+	}
+
+	sealer := engine.inTurn(block.Block_height)
+	if block.Sealer != sealer.String() {
+		return fmt.Errorf("block %d must be sealed by %s, not %s", block.Block_height, sealer, block.Sealer)
+	}
+
+	expected := block
+	expected.generateBlockHash()
+	if expected.Block_hash != block.Block_hash {
+		return fmt.Errorf("block hash does not match its header")
+	}
+
+	pubKey, err := sealer.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("failed to obtain the key of %s: %v", sealer, err)
+	}
+
+	signature, err := hex.DecodeString(block.Signature)
+	if err != nil {
+		return fmt.Errorf("signature is not valid hex: %v", err)
+	}
+
+	valid, err := pubKey.Verify([]byte(block.Block_hash), signature)
+	if err != nil || !valid {
+		return fmt.Errorf("invalid block signature")
+	}
+
+	return nil
+}
+
+// Every block carries the same weight, so the longest chain wins
+func (engine *PoaEngine) ChooseFork(current Block, candidate Block) bool {
+	return candidate.Block_height > current.Block_height
+}
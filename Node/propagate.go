@@ -1,107 +1,42 @@
 package main
 
 import (
-	"bufio"
-	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/libp2p/go-libp2p/core/network"
-	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
-func propagateMessage(rw *bufio.ReadWriter, strm network.Stream) {
+// The broadcast streams are only served for the nodes of the previous release, which push every item on its own stream.
+// The items they send are handled like those of the pubsub topics, and relayed on the topics.
+
+func propagateMessage(wire *Wire, strm network.Stream) {
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Println("Recovered from panic in gossipExecute:", r)
+			fmt.Println("Recovered from panic in propagateMessage:", r)
 		}
 	}()
 
 	for {
-		line, err := rw.ReadString('\n')
-		if err != nil {
-			return
-		}
-
-		if line == "" || line == "\n" {
-			continue
-		}
-
 		var message Message
-		err = json.Unmarshal([]byte(line), &message)
-		if err != nil {
-			fmt.Println("Failed to parse JSON:", err)
+		err := wire.Read(msgMessage, &message)
+		if errors.Is(err, errBadMessage) {
+			misbehaving(strm.Conn().RemotePeer(), penaltyMalformed, err.Error())
 			continue
 		}
-
-		peerMutex.Lock()
-		if small, exist := least[message.Sender]; !exist || message.Message_Id > small {
-			least[message.Sender] = message.Message_Id
-		} else {
-			peerMutex.Unlock()
-			continue
-		}
-		peerMutex.Unlock()
-
-		// Database Access with Mutex
-		peerMutex.Lock()
-		if _, exists := database[message.Sender]; !exists {
-			database[message.Sender] = make(map[int32]string)
-			if _, exists := database[message.Sender][message.Message_Id]; !exists {
-				database[message.Sender][message.Message_Id] = message.Content
-			} else {
-				peerMutex.Unlock()
-				continue
-			}
+		if err != nil {
+			return
 		}
-		peerMutex.Unlock()
 
-		fmt.Printf("\x1b[32m> Message Sent by: %s\n> Message: %s\n> Sent from %s\x1b[0m\n", message.Sender, message.Content, strm.Conn().RemotePeer())
-
-		peerMutex.RLock()
-		peers := peerArray
-		peerMutex.RUnlock()
-
-		for _, peer := range peers {
-			if peer.ID == strm.Conn().RemotePeer() || peer.ID.String() == message.Sender {
-				continue
-			}
-
-			stream, err := User.NewStream(context.Background(), peer.ID, protocol.ID("/chat/1.0.0/gossip"))
-			if err != nil {
-				continue
-			}
-
-			rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
-
-			data, err := json.Marshal(message)
-			if err != nil {
-				fmt.Println("Failed to serialize message:", err)
-				stream.Close()
-				continue
-			}
-
-			_, err = rw.WriteString(string(data) + "\n")
-			if err != nil {
-				fmt.Println("Failed to send message to peer:", peer.ID, err)
-				stream.Close()
-				continue
-			}
-
-			err = rw.Flush()
-			if err != nil {
-				fmt.Println("Failed to flush data to peer:", peer.ID, err)
-				stream.Close()
-				continue
-			}
-
-			stream.Close()
+		if receiveMessage(strm.Conn().RemotePeer(), message) == validationAccept {
+			publish(topicMessages, message)
 		}
 	}
 }
 
 // Propagate the transaction to the network - Mempool
-func propagateTxn(rw *bufio.ReadWriter, strm network.Stream) {
+func propagateTxn(wire *Wire, strm network.Stream) {
 	defer func() {
 		if r := recover(); r != nil {
 			fmt.Println("Recovered from panic in propagateTxn:", r)
@@ -109,190 +44,206 @@ func propagateTxn(rw *bufio.ReadWriter, strm network.Stream) {
 	}()
 
 	for {
-		line, err := rw.ReadString('\n')
-		if err != nil {
-			return
-		}
-
-		if line == "" || line == "\n" {
+		var transaction Transaction
+		err := wire.Read(msgTransaction, &transaction)
+		if errors.Is(err, errBadMessage) {
+			misbehaving(strm.Conn().RemotePeer(), penaltyMalformed, err.Error())
 			continue
 		}
-
-		var transaction Transaction
-		err = json.Unmarshal([]byte(line), &transaction)
 		if err != nil {
-			fmt.Println("Failed to parse JSON:", err)
-			continue
+			return
 		}
 
-		// Add the transaction to the mempool
-		MempoolMutex.Lock()
-		if _, exists := Mempool[transaction.Txn_id]; !exists {
-			Mempool[transaction.Txn_id] = transaction
-		} else {
-			MempoolMutex.Unlock()
-			continue
-		}
-		MempoolMutex.Unlock()
-
-		fmt.Printf("\x1b[32m> New Txn Added to Mempool\n> Txn_id: %s\n> Sent from %s\x1b[0m\n", transaction.Txn_id, strm.Conn().RemotePeer())
-
-		peerMutex.RLock()
-		peers := peerArray
-		peerMutex.RUnlock()
-
-		for _, peer := range peers {
-			if peer.ID == strm.Conn().RemotePeer() {
-				continue
-			}
-
-			stream, err := User.NewStream(context.Background(), peer.ID, protocol.ID("/blockchain/1.0.0/broadcast/transaction"))
-			if err != nil {
-				continue
-			}
-
-			rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
-
-			data, err := json.Marshal(transaction)
-			if err != nil {
-				fmt.Println("Failed to serialize transaction:", err)
-				stream.Close()
-				continue
-			}
-
-			_, err = rw.WriteString(string(data) + "\n")
-			if err != nil {
-				fmt.Println("Failed to send transaction to peer:", peer.ID, err)
-				stream.Close()
-				continue
-			}
-
-			err = rw.Flush()
-			if err != nil {
-				fmt.Println("Failed to flush data to peer:", peer.ID, err)
-				stream.Close()
-				continue
-			}
-
-			stream.Close()
+		if receiveTransaction(strm.Conn().RemotePeer(), transaction) == validationAccept {
+			relayTransaction(transaction)
 		}
 	}
 }
 
 // Validate the block and propagate it to the network
-func propagateBlock(rw *bufio.ReadWriter, strm network.Stream) {
+func propagateBlock(wire *Wire, strm network.Stream) {
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Println("Recovered from panic in gossipExecute:", r)
+			fmt.Println("Recovered from panic in propagateBlock:", r)
 		}
 	}()
 
 	for {
-		line, err := rw.ReadString('\n')
+		var blockDTO BlockDTO
+		err := wire.Read(msgBlockDTO, &blockDTO)
+		if errors.Is(err, errBadMessage) {
+			misbehaving(strm.Conn().RemotePeer(), penaltyMalformed, err.Error())
+			continue
+		}
 		if err != nil {
 			return
 		}
 
-		if line == "" || line == "\n" {
-			continue
+		switch receiveBlock(strm.Conn().RemotePeer(), blockDTO) {
+		case validationAccept:
+			relayBlock(blockDTO)
+		case validationReject:
+			return
 		}
+	}
+}
 
-		var blockDTO BlockDTO
-		err = json.Unmarshal([]byte(line), &blockDTO)
-		if err != nil {
-			fmt.Println("Failed to parse JSON:", err)
-			continue
+// Show a gossip message the first time it arrives
+func receiveMessage(from peer.ID, message Message) validationResult {
+	peerMutex.Lock()
+	if small, exist := least[message.Sender]; !exist || message.Message_Id > small {
+		least[message.Sender] = message.Message_Id
+	} else {
+		peerMutex.Unlock()
+		return validationIgnore
+	}
+	peerMutex.Unlock()
+
+	// Database Access with Mutex
+	peerMutex.Lock()
+	if _, exists := database[message.Sender]; !exists {
+		database[message.Sender] = make(map[int32]string)
+		if _, exists := database[message.Sender][message.Message_Id]; !exists {
+			database[message.Sender][message.Message_Id] = message.Content
+		} else {
+			peerMutex.Unlock()
+			return validationIgnore
 		}
+	}
+	peerMutex.Unlock()
+
+	fmt.Printf("\x1b[32m> Message Sent by: %s\n> Message: %s\n> Sent from %s\x1b[0m\n", message.Sender, message.Content, from)
+	return validationAccept
+}
+
+// Admit a transaction from a peer to the mempool - only the transactions the mempool accepts are relayed
+func receiveTransaction(from peer.ID, transaction Transaction) validationResult {
+	err := acceptToMempool(transaction)
+	if err != nil {
+		if !isDuplicate(err) {
+			fmt.Println("Rejected transaction", transaction.Txn_id+":", err)
+		}
+
+		var rejectErr *RejectError
+		if errors.As(err, &rejectErr) && rejectErr.Code == rejectInvalid {
+			misbehaving(from, penaltyInvalidTxn, "invalid transaction: "+rejectErr.Reason)
+			return validationReject
+		}
+		return validationIgnore
+	}
 
-		// Add the block to the blockchain database
-		BlockMutex.RLock()
-		_, exists := Blockchain[blockDTO.Block_hash]
-		BlockMutex.RUnlock()
+	notifyNewTxn(transaction)
+	creditPeer(from)
 
+	fmt.Printf("\x1b[32m> New Txn Added to Mempool\n> Txn_id: %s\n> Sent from %s\x1b[0m\n", transaction.Txn_id, from)
+	return validationAccept
+}
+
+// Rebuild an announced block from the mempool, or fetch it from the peer, and add it to the chain.
+// Only the blocks moving the tip are relayed.
+func receiveBlock(from peer.ID, blockDTO BlockDTO) validationResult {
+	BlockMutex.RLock()
+	_, exists := Blockchain[blockDTO.Block_hash]
+	BlockMutex.RUnlock()
+
+	if exists {
+		return validationIgnore
+	}
+
+	// Make the Block
+	block := Block{
+		Block_hash:    blockDTO.Block_hash,
+		Block_height:  blockDTO.Block_height,
+		Previous_hash: blockDTO.Previous_hash,
+		Nonce:         blockDTO.Nonce,
+		Difficulty:    blockDTO.Difficulty,
+		Merkle_hash:   blockDTO.Merkle_hash,
+		Timestamp:     blockDTO.Timestamp,
+		Transactions:  []Transaction{},
+		Sealer:        blockDTO.Sealer,
+		Signature:     blockDTO.Signature,
+	}
+
+	// Add Transactions to the Block
+	missing := false
+	MempoolMutex.RLock()
+	for _, txn := range blockDTO.Transactions {
+		transaction, exists := Mempool[txn]
 		if !exists {
-			// Make the Block
-			block := Block{
-				Block_hash:    blockDTO.Block_hash,
-				Block_height:  blockDTO.Block_height,
-				Previous_hash: blockDTO.Previous_hash,
-				Nonce:         blockDTO.Nonce,
-				Difficulty:    blockDTO.Difficulty,
-				Merkle_hash:   blockDTO.Merkle_hash,
-				Timestamp:     blockDTO.Timestamp,
-				Transactions:  []Transaction{},
-			}
-
-			// Add Transactions to the Block
-			for _, txn := range blockDTO.Transactions {
-				transaction := Mempool[txn]
-				block.Transactions = append(block.Transactions, transaction)
-			}
-
-			// Validate the Block
-			err := validateBlock(block)
-			if err != nil {
-				fmt.Println("Block Validation Failed: Stopping propagation", err)
-				return
-			}
-
-			// Stop mining since a new block is confirmed
-			if miningCancel != nil {
-				miningCancel()
-			}
-
-			// Remove Transactions from Mempool & Update UTXO
-			go removeFromMempool(block)
-			go buildMerkle(block.Transactions)
-			Latest_Block = block.Block_hash
-
-			// Add the Block to the database
-			BlockMutex.Lock()
-			Blockchain[block.Block_hash] = block
-			BlockMutex.Unlock()
-		} else {
-			continue
+			missing = true
+			break
 		}
+		block.Transactions = append(block.Transactions, transaction)
+	}
+	MempoolMutex.RUnlock()
 
-		fmt.Printf("\x1b[32m> New Block Added to Blockchain\n> Block_hash: %s\n> Sent from %s\x1b[0m\n", blockDTO.Block_hash, strm.Conn().RemotePeer())
-
-		peerMutex.RLock()
-		peers := peerArray
-		peerMutex.RUnlock()
-
-		for _, peer := range peers {
-			if peer.ID == strm.Conn().RemotePeer() {
-				continue
-			}
-
-			stream, err := User.NewStream(context.Background(), peer.ID, protocol.ID(config.ProtocolID+"/broadcast/block"))
-			if err != nil {
-				continue
-			}
-
-			rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
-
-			data, err := json.Marshal(blockDTO)
-			if err != nil {
-				fmt.Println("Failed to serialize transaction:", err)
-				stream.Close()
-				continue
-			}
-
-			_, err = rw.WriteString(string(data) + "\n")
-			if err != nil {
-				fmt.Println("Failed to send transaction to peer:", peer.ID, err)
-				stream.Close()
-				continue
-			}
-
-			err = rw.Flush()
-			if err != nil {
-				fmt.Println("Failed to flush data to peer:", peer.ID, err)
-				stream.Close()
-				continue
-			}
-
-			stream.Close()
+	// The coinbase, and the transactions not seen yet, come with the full block from the sender
+	if missing {
+		var err error
+		block, err = fetchBlock(from, blockDTO.Block_hash)
+		if err != nil {
+			fmt.Println("Failed to fetch block", blockDTO.Block_hash+":", err)
+			return validationIgnore
 		}
 	}
+
+	// Validate the Block and let the consensus engine pick the tip
+	tipChanged, err := acceptBlock(block)
+	if errors.Is(err, errOrphanBlock) {
+		fmt.Println("Block Validation Failed: Stopping propagation", err)
+		return validationIgnore
+	}
+	if err != nil {
+		fmt.Println("Block Validation Failed: Stopping propagation", err)
+		misbehaving(from, penaltyInvalidBlock, "invalid block: "+err.Error())
+		return validationReject
+	}
+
+	// The peer has the block, whether or not it moved the tip here
+	updatePeerTip(from, block.Block_height, block.Block_hash)
+
+	if !tipChanged {
+		return validationIgnore
+	}
+
+	// Stop mining since a new block is confirmed
+	stopMining()
+
+	creditPeer(from)
+
+	fmt.Printf("\x1b[32m> New Block Added to Blockchain\n> Block_hash: %s\n> Sent from %s\x1b[0m\n", blockDTO.Block_hash, from)
+	return validationAccept
+}
+
+// Make the compact form of a block that is relayed to the peers
+func newBlockDTO(block Block) BlockDTO {
+	blockDTO := BlockDTO{
+		Block_hash:    block.Block_hash,
+		Block_height:  block.Block_height,
+		Previous_hash: block.Previous_hash,
+		Nonce:         block.Nonce,
+		Difficulty:    block.Difficulty,
+		Merkle_hash:   block.Merkle_hash,
+		Timestamp:     block.Timestamp,
+		Transactions:  []string{},
+		Sealer:        block.Sealer,
+		Signature:     block.Signature,
+	}
+
+	// Add the transactions to the BlockDTO
+	for _, txn := range block.Transactions {
+		blockDTO.Transactions = append(blockDTO.Transactions, txn.Txn_id)
+	}
+
+	return blockDTO
+}
+
+// Publish the transaction to the peers, returning how many were reached
+func relayTransaction(transaction Transaction) int {
+	return publish(topicTransactions, transaction)
+}
+
+// Publish the block to the peers
+func relayBlock(blockDTO BlockDTO) {
+	publish(topicBlocks, blockDTO)
 }
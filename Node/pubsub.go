@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Topics relayed between the peers, named by network with topicName
+const (
+	topicTransactions = "transactions"
+	topicBlocks       = "blocks"
+	topicMessages     = "messages"
+)
+
+// Outcome of the validation of a pubsub message
+type validationResult int
+
+const (
+	validationAccept validationResult = iota // Handled, and forwarded to the other peers
+	validationIgnore                         // Dropped without blaming the sender - a duplicate or an orphan
+	validationReject                         // Dropped, and the sender penalized
+)
+
+// Validates and handles the data of a topic message received from a peer, before it is forwarded
+type topicValidator func(from peer.ID, data []byte) validationResult
+
+var topicValidators = map[string]topicValidator{
+	topicTransactions: validateTransactionTopic,
+	topicBlocks:       validateBlockTopic,
+	topicMessages:     validateMessageTopic,
+}
+
+// Topic of the network the node is on
+func topicName(topic string) string {
+	return config.ProtocolID + "/" + topic
+}
+
+// ID of a message, committing to its topic and data - the same item published by two nodes is relayed once
+func pubsubID(message *pb.Message) string {
+	hash := sha256.Sum256(append([]byte(message.GetTopic()+"\n"), message.Data...))
+	return hex.EncodeToString(hash[:])
+}
+
+// Start the GossipSub router and join the topics, validating their messages before they are forwarded
+func startPubsub(ctx context.Context) error {
+	// The default of 1 MB would drop the largest blocks, which the streams carry up to a frame
+	router, err := pubsub.NewGossipSub(ctx, User, pubsub.WithMessageIdFn(pubsubID), pubsub.WithMaxMessageSize(maxFrameSize))
+	if err != nil {
+		return fmt.Errorf("failed to start gossipsub: %v", err)
+	}
+	Pubsub = router
+
+	for topic, validator := range topicValidators {
+		err := Pubsub.RegisterTopicValidator(topicName(topic), gossipValidator(validator))
+		if err != nil {
+			return fmt.Errorf("failed to register the validator of %s: %v", topic, err)
+		}
+
+		joined, err := Pubsub.Join(topicName(topic))
+		if err != nil {
+			return fmt.Errorf("failed to join %s: %v", topic, err)
+		}
+		Pubsub_Topics[topic] = joined
+
+		// The messages are handled by the validators - the subscription only has to be drained
+		subscription, err := joined.Subscribe()
+		if err != nil {
+			return fmt.Errorf("failed to subscribe to %s: %v", topic, err)
+		}
+		go drainSubscription(ctx, subscription)
+	}
+
+	return nil
+}
+
+// Adapt a topic validator to GossipSub. The messages published by the node itself were checked before.
+func gossipValidator(validator topicValidator) pubsub.ValidatorEx {
+	return func(_ context.Context, from peer.ID, message *pubsub.Message) pubsub.ValidationResult {
+		if from == User.ID() {
+			return pubsub.ValidationAccept
+		}
+
+		touchPeer(from)
+
+		switch validator(from, message.Data) {
+		case validationAccept:
+			return pubsub.ValidationAccept
+		case validationReject:
+			return pubsub.ValidationReject
+		}
+		return pubsub.ValidationIgnore
+	}
+}
+
+func drainSubscription(ctx context.Context, subscription *pubsub.Subscription) {
+	defer subscription.Cancel()
+
+	for {
+		_, err := subscription.Next(ctx)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Publish a value on a topic, returning how many peers of the topic it was sent to
+func publish(topic string, value any) int {
+	joined, exists := Pubsub_Topics[topic]
+	if !exists {
+		fmt.Println("Not joined to the pubsub topic", topic)
+		return 0
+	}
+
+	data, err := cborMode.Marshal(value)
+	if err != nil {
+		fmt.Println("Failed to encode pubsub message:", err)
+		return 0
+	}
+
+	err = joined.Publish(context.Background(), data)
+	if err != nil {
+		fmt.Println("Failed to publish pubsub message:", err)
+		return 0
+	}
+
+	return len(joined.ListPeers())
+}
+
+func validateTransactionTopic(from peer.ID, data []byte) validationResult {
+	var transaction Transaction
+	err := cbor.Unmarshal(data, &transaction)
+	if err != nil {
+		misbehaving(from, penaltyMalformed, "malformed transaction: "+err.Error())
+		return validationReject
+	}
+
+	return receiveTransaction(from, transaction)
+}
+
+func validateBlockTopic(from peer.ID, data []byte) validationResult {
+	var blockDTO BlockDTO
+	err := cbor.Unmarshal(data, &blockDTO)
+	if err != nil {
+		misbehaving(from, penaltyMalformed, "malformed block: "+err.Error())
+		return validationReject
+	}
+
+	return receiveBlock(from, blockDTO)
+}
+
+func validateMessageTopic(from peer.ID, data []byte) validationResult {
+	var message Message
+	err := cbor.Unmarshal(data, &message)
+	if err != nil {
+		misbehaving(from, penaltyMalformed, "malformed message: "+err.Error())
+		return validationReject
+	}
+
+	return receiveMessage(from, message)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/libp2p/go-libp2p"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestGossipValidator(t *testing.T) {
+	resetState(t)
+	other := peer.ID(t.Name())
+
+	tests := []struct {
+		name   string
+		from   peer.ID
+		result validationResult
+		want   pubsub.ValidationResult
+		called bool
+	}{
+		{"accepted", other, validationAccept, pubsub.ValidationAccept, true},
+		{"ignored", other, validationIgnore, pubsub.ValidationIgnore, true},
+		{"rejected", other, validationReject, pubsub.ValidationReject, true},
+		{"published by the node", User.ID(), validationReject, pubsub.ValidationAccept, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			called := false
+			validator := gossipValidator(func(from peer.ID, data []byte) validationResult {
+				called = true
+				return test.result
+			})
+
+			message := &pubsub.Message{Message: &pb.Message{Data: []byte("data")}}
+			if got := validator(context.Background(), test.from, message); got != test.want {
+				t.Errorf("result %v, want %v", got, test.want)
+			}
+			if called != test.called {
+				t.Errorf("validator called = %v, want %v", called, test.called)
+			}
+		})
+	}
+}
+
+func TestTopicValidatorsRejectMalformed(t *testing.T) {
+	for topic, validator := range topicValidators {
+		t.Run(topic, func(t *testing.T) {
+			resetState(t)
+			from := peer.ID(t.Name())
+
+			if got := validator(from, []byte{0xff}); got != validationReject {
+				t.Errorf("malformed data validated as %v", got)
+			}
+			if Peer_Scores[from.String()] != penaltyMalformed {
+				t.Errorf("score %d, want %d", Peer_Scores[from.String()], penaltyMalformed)
+			}
+		})
+	}
+}
+
+func TestPubsubRelay(t *testing.T) {
+	resetState(t)
+	ctx := context.Background()
+
+	// A remote node on the same topics, stopped and forgotten before the next test resets the state
+	remote, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteCtx, stopRemote := context.WithCancel(ctx)
+	t.Cleanup(func() {
+		stopRemote()
+		remote.Close()
+		waitPeer(t, remote.ID(), false)
+	})
+
+	router, err := pubsub.NewGossipSub(remoteCtx, remote, pubsub.WithMessageIdFn(pubsubID), pubsub.WithMaxMessageSize(maxFrameSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transactions, err := router.Join(topicName(topicTransactions))
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := router.Join(topicName(topicMessages))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscription, err := messages.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = User.Connect(ctx, peer.AddrInfo{ID: remote.ID(), Addrs: remote.Addrs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the subscriptions to be exchanged
+	waitFor(t, func() bool {
+		return slices.Contains(Pubsub_Topics[topicMessages].ListPeers(), remote.ID()) &&
+			slices.Contains(transactions.ListPeers(), User.ID())
+	})
+
+	// Published by the node - the first messages may go out before the remote node is ready for them
+	var received *pubsub.Message
+	for id := int32(1); received == nil; id++ {
+		if id > 25 {
+			t.Fatal("message not received by the remote node")
+		}
+
+		sent := Message{Sender: User.ID().String(), Message_Id: id, Content: "hello"}
+		if reached := publish(topicMessages, sent); reached != 1 {
+			t.Fatalf("published to %d peers, want 1", reached)
+		}
+
+		timeout, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		received, _ = subscription.Next(timeout)
+		cancel()
+	}
+
+	var message Message
+	if err := cbor.Unmarshal(received.Data, &message); err != nil || message.Content != "hello" {
+		t.Errorf("remote node received %+v, %v", message, err)
+	}
+
+	// Larger than the default limit of the routers, though within a frame - and new to them on every run
+	large := Message{Sender: User.ID().String(), Message_Id: 100, Content: time.Now().String() + strings.Repeat("x", 2<<20)}
+	publish(topicMessages, large)
+	timeout, cancel := context.WithTimeout(ctx, 5*time.Second)
+	received, err = subscription.Next(timeout)
+	cancel()
+	if err != nil || len(received.Data) < 2<<20 {
+		t.Errorf("large message not received by the remote node: %v", err)
+	}
+
+	// Published by the remote node, admitted to the mempool by the validator of the topic.
+	// The node's own subscription only gets the message once the validator returned.
+	validated, err := Pubsub_Topics[topicTransactions].Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer validated.Cancel()
+
+	txn := fundedSpend(t, "funding", 0.01)
+	data, err := cborMode.Marshal(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := transactions.Publish(ctx, data); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout, cancel = context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if _, err := validated.Next(timeout); err != nil {
+		t.Fatalf("transaction not validated by the node: %v", err)
+	}
+
+	MempoolMutex.RLock()
+	_, exists := Mempool[txn.Txn_id]
+	MempoolMutex.RUnlock()
+	if !exists {
+		t.Error("transaction published by the remote node not in the mempool")
+	}
+}
+
+// Wait up to a few seconds for the condition
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatal("condition not met in time")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Limits on the streams a peer opens for a node protocol
+type streamLimit struct {
+	Rate       float64 // Streams per second the peer is allowed on average
+	Burst      float64 // Streams the peer can open at once after being idle
+	Concurrent int     // Streams of the peer served at the same time
+}
+
+// Limits of each node protocol, per peer
+var streamLimits = map[string]streamLimit{
+	"/handshake":             {Rate: 0.1, Burst: 3, Concurrent: 1},
+	"/message":               {Rate: 1, Burst: 10, Concurrent: 2},
+	"/gossip":                {Rate: 5, Burst: 20, Concurrent: 4},
+	"/broadcast/transaction": {Rate: 20, Burst: 100, Concurrent: 8},
+	"/broadcast/block":       {Rate: 2, Burst: 10, Concurrent: 4},
+	"/multisig/sign":         {Rate: 1, Burst: 5, Concurrent: 2},
+	"/download/headers":      {Rate: 2, Burst: 20, Concurrent: 1},
+	"/download/mempool":      {Rate: 0.2, Burst: 5, Concurrent: 2},
+	"/download/block":        {Rate: 10, Burst: 50, Concurrent: 4},
+	"/download/transaction":  {Rate: 5, Burst: 20, Concurrent: 4},
+	"/download/blockchain":   {Rate: 0.1, Burst: 3, Concurrent: 1},
+}
+
+// Limits of a protocol missing from the table
+var defaultStreamLimit = streamLimit{Rate: 1, Burst: 10, Concurrent: 2}
+
+// Streams of a peer for one protocol
+type streamKey struct {
+	Peer peer.ID
+	Path string
+}
+
+// Token bucket of the streams a peer may still open, with the streams being served
+type streamBucket struct {
+	Tokens  float64
+	Updated time.Time
+	Active  int
+}
+
+// Serve only the streams within the limits of the protocol, penalizing the peers going beyond them
+func limitStreams(path string, handler network.StreamHandler) network.StreamHandler {
+	limit, exists := streamLimits[path]
+	if !exists {
+		limit = defaultStreamLimit
+	}
+
+	return func(stream network.Stream) {
+		key := streamKey{Peer: stream.Conn().RemotePeer(), Path: path}
+
+		err := acquireStream(key, limit)
+		if err != nil {
+			stream.Reset()
+			misbehaving(key.Peer, penaltyRateLimit, err.Error())
+			return
+		}
+		defer releaseStream(key)
+
+		touchPeer(key.Peer)
+		handler(stream)
+	}
+}
+
+// Take a token from the bucket of the peer and count the stream as served
+func acquireStream(key streamKey, limit streamLimit) error {
+	LimitMutex.Lock()
+	defer LimitMutex.Unlock()
+
+	now := time.Now()
+	bucket, exists := Stream_Buckets[key]
+	if !exists {
+		bucket = &streamBucket{Tokens: limit.Burst, Updated: now}
+		Stream_Buckets[key] = bucket
+	}
+
+	// Refill for the time since the last stream
+	bucket.Tokens = min(bucket.Tokens+now.Sub(bucket.Updated).Seconds()*limit.Rate, limit.Burst)
+	bucket.Updated = now
+
+	if bucket.Active >= limit.Concurrent {
+		return fmt.Errorf("more than %d concurrent %s streams", limit.Concurrent, key.Path)
+	}
+
+	if bucket.Tokens < 1 {
+		return fmt.Errorf("%s streams opened faster than %.1f per second", key.Path, limit.Rate)
+	}
+
+	bucket.Tokens--
+	bucket.Active++
+	return nil
+}
+
+func releaseStream(key streamKey) {
+	LimitMutex.Lock()
+	defer LimitMutex.Unlock()
+
+	bucket, exists := Stream_Buckets[key]
+	if exists {
+		bucket.Active--
+	}
+}
+
+// Forget the buckets of a peer that is gone
+func forgetStreams(peerID peer.ID) {
+	LimitMutex.Lock()
+	defer LimitMutex.Unlock()
+
+	for key, bucket := range Stream_Buckets {
+		if key.Peer == peerID && bucket.Active == 0 {
+			delete(Stream_Buckets, key)
+		}
+	}
+}
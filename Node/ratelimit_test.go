@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestAcquireStream(t *testing.T) {
+	limit := streamLimit{Rate: 1, Burst: 3, Concurrent: 2}
+
+	tests := []struct {
+		name    string
+		tokens  float64       // Tokens left in the bucket
+		idle    time.Duration // Time since the last stream
+		active  int           // Streams being served
+		allowed bool
+	}{
+		{"tokens left", 2, 0, 0, true},
+		{"bucket empty", 0.5, 0, 0, false},
+		{"refilled while idle", 0, 2 * time.Second, 0, true},
+		{"refill capped at the burst", 3, time.Hour, 1, true},
+		{"too many concurrent streams", 3, 0, 2, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetState(t)
+			key := streamKey{Peer: peer.ID(t.Name()), Path: "/test"}
+			Stream_Buckets[key] = &streamBucket{Tokens: test.tokens, Updated: time.Now().Add(-test.idle), Active: test.active}
+
+			err := acquireStream(key, limit)
+			if (err == nil) != test.allowed {
+				t.Fatalf("allowed = %v, want %v (%v)", err == nil, test.allowed, err)
+			}
+
+			bucket := Stream_Buckets[key]
+			if bucket.Tokens > limit.Burst {
+				t.Errorf("%.1f tokens, above the burst of %.1f", bucket.Tokens, limit.Burst)
+			}
+			active := test.active
+			if test.allowed {
+				active++
+			}
+			if bucket.Active != active {
+				t.Errorf("%d active streams, want %d", bucket.Active, active)
+			}
+		})
+	}
+}
+
+func TestStreamBurst(t *testing.T) {
+	resetState(t)
+	limit := streamLimit{Rate: 0.001, Burst: 5, Concurrent: 10}
+	key := streamKey{Peer: peer.ID(t.Name()), Path: "/test"}
+
+	for idx := 0; idx < int(limit.Burst); idx++ {
+		if err := acquireStream(key, limit); err != nil {
+			t.Fatalf("stream %d of the burst refused: %v", idx, err)
+		}
+		releaseStream(key)
+	}
+
+	if err := acquireStream(key, limit); err == nil {
+		t.Error("stream beyond the burst allowed")
+	}
+
+	// The buckets of a peer are forgotten once its streams are done
+	forgetStreams(key.Peer)
+	if _, exists := Stream_Buckets[key]; exists {
+		t.Error("bucket kept after the peer left")
+	}
+}
+
+func TestLimitStreams(t *testing.T) {
+	resetState(t)
+	remote := remoteHost(t)
+	limit := streamLimits["/download/mempool"]
+
+	served := make(chan bool, int(limit.Burst)+1)
+	User.SetStreamHandler("/test/limited", limitStreams("/download/mempool", func(stream network.Stream) {
+		served <- true
+		stream.Close()
+	}))
+	defer User.RemoveStreamHandler("/test/limited")
+
+	// The streams of the burst are served, the next one is reset
+	for idx := 0; idx <= int(limit.Burst); idx++ {
+		stream, err := remote.NewStream(context.Background(), User.ID(), "/test/limited")
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.Read(make([]byte, 1))
+		stream.Close()
+	}
+
+	if len(served) != int(limit.Burst) {
+		t.Errorf("%d streams served, want the burst of %.0f", len(served), limit.Burst)
+	}
+	// The peer is penalized once its stream is reset
+	score := 0
+	for deadline := time.Now().Add(5 * time.Second); score == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		BanMutex.RLock()
+		score = Peer_Scores[remote.ID().String()]
+		BanMutex.RUnlock()
+	}
+	if score != penaltyRateLimit {
+		t.Errorf("score %d after going over the limit, want %d", score, penaltyRateLimit)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReplaceByFee(t *testing.T) {
+	resetState(t)
+
+	original := fundedSpend(t, "funding", 0.01)
+	if err := acceptToMempool(original); err != nil {
+		t.Fatal(err)
+	}
+
+	// A descendant of the original, evicted along with it
+	child := spendOutput(original.Txn_id, walletPubkey(), 0.98, 0.01)
+	MempoolMutex.Lock()
+	insertMempool(child)
+	MempoolMutex.Unlock()
+
+	replace := func(fee float64) error {
+		txn := spendOutput("funding", walletPubkey(), 1-fee, fee)
+		signInputs(&txn, Wallet_Key)
+		return acceptToMempool(txn)
+	}
+
+	// The original and its child pay 0.02 together
+	if err := replace(0.015); rejectCode(err) != rejectConflict {
+		t.Errorf("replacement paying less than the replaced package: %v", err)
+	}
+	if err := replace(0.02); rejectCode(err) != rejectConflict {
+		t.Errorf("replacement without the fee increment: %v", err)
+	}
+
+	// A replacement cannot pay for itself with the outputs it evicts
+	selfFunded := spendOutput("funding", walletPubkey(), 0.5, 0.1)
+	selfFunded.Inputs = append(selfFunded.Inputs, Input{Txn_id: original.Txn_id, Index: 0})
+	selfFunded.In_sz = 2
+	selfFunded.generateTxn()
+	signInputs(&selfFunded, Wallet_Key)
+	if err := acceptToMempool(selfFunded); rejectCode(err) != rejectConflict {
+		t.Errorf("replacement spending the replaced transaction: %v", err)
+	}
+
+	if _, exists := Mempool[original.Txn_id]; !exists || len(Mempool) != 2 {
+		t.Fatalf("rejected replacements changed the mempool: %d transactions", len(Mempool))
+	}
+
+	if err := replace(0.03); err != nil {
+		t.Fatalf("replacement paying for the package rejected: %v", err)
+	}
+	if _, exists := Mempool[original.Txn_id]; exists {
+		t.Error("replaced transaction kept")
+	}
+	if _, exists := Mempool[child.Txn_id]; exists {
+		t.Error("descendant of the replaced transaction kept")
+	}
+	if len(Mempool) != 1 || len(Mempool_Spends) != 1 {
+		t.Errorf("%d transactions spending %d outputs in the mempool, want the replacement alone", len(Mempool), len(Mempool_Spends))
+	}
+}
+
+func TestReplaceByFeeEvictionLimit(t *testing.T) {
+	for _, children := range []int{maxReplacements - 1, maxReplacements} {
+		t.Run(fmt.Sprint(children, " children"), func(t *testing.T) {
+			resetState(t)
+			replacement := fundedSpend(t, "funding", 0.5)
+
+			// A parent whose outputs are each spent by a child
+			parent := Transaction{In_sz: 1, Out_sz: int32(children), Fee: 0.01, Inputs: []Input{{Txn_id: "funding", Index: 0}}, Timestamp: time.Now()}
+			for i := 0; i < children; i++ {
+				parent.Outputs = append(parent.Outputs, Output{Pubkey: walletPubkey(), Value: 0.009})
+			}
+			parent.generateTxn()
+			if err := signInputs(&parent, Wallet_Key); err != nil {
+				t.Fatal(err)
+			}
+			if err := acceptToMempool(parent); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < children; i++ {
+				child := spendOutput(parent.Txn_id, walletPubkey(), 0.007, 0.001)
+				child.Inputs[0].Index = int32(i)
+				child.generateTxn()
+				if err := signInputs(&child, Wallet_Key); err != nil {
+					t.Fatal(err)
+				}
+				if err := acceptToMempool(child); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The parent and its children are evicted together
+			err := acceptToMempool(replacement)
+			if evicted := children + 1; evicted > maxReplacements {
+				if rejectCode(err) != rejectConflict {
+					t.Fatalf("replacement evicting %d transactions: %v, want a conflict", evicted, err)
+				}
+			} else if err != nil {
+				t.Fatalf("replacement evicting %d transactions rejected: %v", evicted, err)
+			}
+		})
+	}
+}
@@ -1,21 +1,26 @@
 package main
 
-import (
-	"github.com/libp2p/go-libp2p/core/protocol"
-)
-
 func SetNodeHandlers() {
+	// Handshake handlers
+	setWireHandler("/handshake", exchangeHandshake)
+
 	// Message handlers
-	User.SetStreamHandler(protocol.ID(config.ProtocolID+"/message"), messageProtocol)
-	User.SetStreamHandler(protocol.ID(config.ProtocolID+"/gossip"), broadcastMessage)
+	setWireHandler("/message", messageProtocol)
+	setWireHandler("/gossip", broadcastMessage)
 
-	// Propagation handlers
-	User.SetStreamHandler(protocol.ID(config.ProtocolID+"/broadcast/transaction"), broadcastTxn)
-	User.SetStreamHandler(protocol.ID(config.ProtocolID+"/broadcast/block"), broadcastBlock)
+	// Propagation handlers - for the nodes of the previous release
+	setWireHandler("/broadcast/transaction", broadcastTxn)
+	setWireHandler("/broadcast/block", broadcastBlock)
+
+	// Multisig handlers
+	setWireHandler("/multisig/sign", cosignTxn)
 
 	// Download handlers
-	User.SetStreamHandler(protocol.ID(config.ProtocolID+"/download/blockchain"), exportBlockchain)
-	User.SetStreamHandler(protocol.ID(config.ProtocolID+"/download/mempool"), exportMempool)
-	User.SetStreamHandler(protocol.ID(config.ProtocolID+"/download/block"), exportBlock)
-	User.SetStreamHandler(protocol.ID(config.ProtocolID+"/download/transaction"), exportTransaction)
+	setWireHandler("/download/headers", exportHeaders)
+	setWireHandler("/download/mempool", exportMempool)
+	setWireHandler("/download/block", exportBlock)
+	setWireHandler("/download/transaction", exportTransaction)
+
+	// Full chain download - for the nodes of the previous release, deprecated
+	setLegacyHandler("/download/blockchain", exportBlockchain)
 }
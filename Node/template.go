@@ -0,0 +1,265 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Bytes kept free in a block template for the coinbase
+const coinbaseReserve = 512
+
+var (
+	templateSignal = make(chan struct{}, 1) // Wakes the auto miner to rebuild its template
+	templateMutex  sync.RWMutex             // Mutex for the template stats
+	templateFull   bool                     // The current template hit the block limits
+	templateMinFee float64                  // Lowest fee rate in the current template
+)
+
+// Serialized size of the transaction in bytes
+func txnSize(txn Transaction) int {
+	data, _ := json.Marshal(txn)
+	return len(data)
+}
+
+// Size of a block as the serialized size of its transactions
+func blockSize(block Block) int {
+	size := 0
+	for _, txn := range block.Transactions {
+		size += txnSize(txn)
+	}
+	return size
+}
+
+// Fee per kilobyte of a transaction, or of a package of transactions together, from its size in bytes
+func feeRate(fee float64, size int) float64 {
+	return fee / float64(size) * 1000
+}
+
+// Package of a mempool transaction with its ancestors not selected yet
+type packageEntry struct {
+	txnID   string
+	fee     float64
+	size    int
+	version int // Outdated once one of the ancestors is selected
+}
+
+// Packages ordered by their combined fee rate, the best paying first
+type packageHeap []packageEntry
+
+func (packages packageHeap) Len() int { return len(packages) }
+
+func (packages packageHeap) Less(i, j int) bool {
+	rateI, rateJ := feeRate(packages[i].fee, packages[i].size), feeRate(packages[j].fee, packages[j].size)
+	if rateI != rateJ {
+		return rateI > rateJ
+	}
+	return packages[i].txnID < packages[j].txnID
+}
+
+func (packages packageHeap) Swap(i, j int) { packages[i], packages[j] = packages[j], packages[i] }
+
+func (packages *packageHeap) Push(entry any) { *packages = append(*packages, entry.(packageEntry)) }
+
+func (packages *packageHeap) Pop() any {
+	old := *packages
+	entry := old[len(old)-1]
+	*packages = old[:len(old)-1]
+	return entry
+}
+
+// Pick the mempool transactions for the next block - the packages of a transaction with its unconfirmed ancestors
+// are ranked by their combined fee rate, so a child paying a high fee pulls its parents in
+func selectTransactions() ([]string, float64) {
+	height := nextBlockHeight()
+	now := time.Now()
+
+	MempoolMutex.RLock()
+	pool := make(map[string]Transaction, len(Mempool))
+	sizes := make(map[string]int, len(Mempool))
+	for txnID, txn := range Mempool {
+		pool[txnID] = txn
+		sizes[txnID] = Mempool_Info[txnID].Size
+	}
+	MempoolMutex.RUnlock()
+
+	// Only final transactions can be mined
+	view := newMempoolView(pool, height)
+	final := map[string]bool{}
+	for txnID, txn := range pool {
+		if checkLocks(txn, height, now, view) == nil {
+			final[txnID] = true
+		}
+	}
+
+	ancestors := map[string][]string{}
+	descendants := map[string][]string{}
+	for txnID, txn := range pool {
+		ancestors[txnID] = txnAncestors(txn, pool)
+		for _, ancestor := range ancestors[txnID] {
+			descendants[ancestor] = append(descendants[ancestor], txnID)
+		}
+	}
+
+	// Every transaction starts as a package with all its ancestors
+	packages := make(packageHeap, 0, len(pool))
+	versions := map[string]int{}
+	for txnID, txn := range pool {
+		entry := packageEntry{txnID: txnID, fee: txn.Fee, size: sizes[txnID]}
+		for _, ancestor := range ancestors[txnID] {
+			entry.fee += pool[ancestor].Fee
+			entry.size += sizes[ancestor]
+		}
+		packages = append(packages, entry)
+	}
+	heap.Init(&packages)
+
+	selected := []string{}
+	included := map[string]bool{}
+	skipped := map[string]bool{}
+	fees := 0.0
+	size := coinbaseReserve
+	full := false
+	minRate := 0.0
+
+	for packages.Len() > 0 {
+		// The best paying package of the transactions left
+		best := heap.Pop(&packages).(packageEntry)
+		if included[best.txnID] || skipped[best.txnID] || best.version != versions[best.txnID] {
+			continue
+		}
+
+		bestPackage := []string{best.txnID}
+		mineable := final[best.txnID]
+		for _, ancestor := range ancestors[best.txnID] {
+			if included[ancestor] {
+				continue
+			}
+			if !final[ancestor] || skipped[ancestor] {
+				mineable = false
+			}
+			bestPackage = append(bestPackage, ancestor)
+		}
+
+		// A package with a non-final or left out member cannot be mined
+		if !mineable {
+			skipped[best.txnID] = true
+			continue
+		}
+
+		if len(selected)+len(bestPackage) > config.MaxBlockTxns || size+best.size > config.MaxBlockSize {
+			full = true
+			skipped[best.txnID] = true
+			continue
+		}
+
+		// Parents go before their children - an ancestor has fewer ancestors than its descendants
+		sort.Slice(bestPackage, func(i, j int) bool {
+			return len(ancestors[bestPackage[i]]) < len(ancestors[bestPackage[j]])
+		})
+
+		for _, member := range bestPackage {
+			selected = append(selected, member)
+			included[member] = true
+		}
+		fees += best.fee
+		size += best.size
+
+		if rate := feeRate(best.fee, best.size); len(selected) == len(bestPackage) || rate < minRate {
+			minRate = rate
+		}
+
+		// Only the packages of the descendants change - they no longer carry the selected transactions
+		changed := map[string]packageEntry{}
+		for _, member := range bestPackage {
+			for _, descendant := range descendants[member] {
+				if included[descendant] {
+					continue
+				}
+
+				entry, exists := changed[descendant]
+				if !exists {
+					entry = packageEntry{txnID: descendant, fee: pool[descendant].Fee, size: sizes[descendant]}
+					for _, ancestor := range ancestors[descendant] {
+						if !included[ancestor] {
+							entry.fee += pool[ancestor].Fee
+							entry.size += sizes[ancestor]
+						}
+					}
+					changed[descendant] = entry
+				}
+			}
+		}
+		for descendant, entry := range changed {
+			versions[descendant]++
+			entry.version = versions[descendant]
+			heap.Push(&packages, entry)
+		}
+	}
+
+	templateMutex.Lock()
+	templateFull = full
+	templateMinFee = minRate
+	templateMutex.Unlock()
+
+	return selected, fees
+}
+
+// Build the next block from the best paying mempool transactions
+func buildTemplate() (Block, error) {
+	transactions, fees := selectTransactions()
+
+	return createBlock(transactions, fees)
+}
+
+// Wake the auto miner, without blocking when a wake up is already pending
+func notifyTemplate() {
+	select {
+	case templateSignal <- struct{}{}:
+	default:
+	}
+}
+
+// Wake the auto miner if a new mempool transaction, with its ancestors, pays better than the current template
+func notifyNewTxn(txn Transaction) {
+	if !config.Mine {
+		return
+	}
+
+	// The transaction is mined along with its unconfirmed ancestors
+	MempoolMutex.RLock()
+	fee, size := txn.Fee, txnSize(txn)
+	for _, ancestor := range txnAncestors(txn, Mempool) {
+		fee += Mempool[ancestor].Fee
+		size += Mempool_Info[ancestor].Size
+	}
+	MempoolMutex.RUnlock()
+
+	templateMutex.RLock()
+	better := !templateFull || feeRate(fee, size) > templateMinFee
+	templateMutex.RUnlock()
+
+	if better {
+		notifyTemplate()
+	}
+}
+
+// Keep mining on a fresh template, rebuilding it on a new tip or better paying transactions
+func autoMine() {
+	logger.Info("Auto mining started")
+
+	for {
+		block, err := buildTemplate()
+		if err != nil {
+			fmt.Println("Failed to build block template:", err)
+		} else {
+			logger.Info(fmt.Sprintf("Mining block %d with %d transactions", block.Block_height, len(block.Transactions)-1))
+			startMining(block)
+		}
+
+		<-templateSignal
+	}
+}
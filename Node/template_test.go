@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Mempool transaction paying the fee, spending the outputs of the parents
+func mempoolTxn(name string, fee float64, lockTime int64, parents ...string) Transaction {
+	txn := Transaction{Txn_id: name, Fee: fee, Lock_time: lockTime, Outputs: []Output{{Value: 1}}, Timestamp: time.Now()}
+	for _, parent := range parents {
+		txn.Inputs = append(txn.Inputs, Input{Txn_id: parent})
+	}
+
+	insertMempool(txn)
+	return txn
+}
+
+func TestSelectTransactions(t *testing.T) {
+	tests := []struct {
+		maxTxns int
+		want    []string
+		full    bool
+	}{
+		{10, []string{"cheap", "child", "rich"}, false},
+		{2, []string{"cheap", "child"}, true},
+		{0, []string{}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprint("at most ", test.maxTxns), func(t *testing.T) {
+			resetState(t)
+			config.MaxBlockTxns = test.maxTxns
+			config.MaxBlockSize = 1000000
+
+			mempoolTxn("cheap", 0.001, 0)
+			mempoolTxn("rich", 0.01, 0)
+			mempoolTxn("child", 0.05, 0, "cheap")
+			mempoolTxn("locked", 0.1, 100)
+
+			// The child pays enough to pull its cheap parent in ahead of the rich transaction,
+			// and the locked transaction is not final
+			selected, fees := selectTransactions()
+			if fmt.Sprint(selected) != fmt.Sprint(test.want) {
+				t.Fatalf("selected %v, want %v", selected, test.want)
+			}
+
+			wantFees := 0.0
+			for _, txnID := range test.want {
+				wantFees += Mempool[txnID].Fee
+			}
+			if fees != wantFees || templateFull != test.full {
+				t.Errorf("fees %.3f, full = %v, want %.3f, full = %v", fees, templateFull, wantFees, test.full)
+			}
+		})
+	}
+}
+
+func TestSelectTransactionsUpdatesDescendants(t *testing.T) {
+	resetState(t)
+	config.MaxBlockTxns = 10
+	config.MaxBlockSize = 1000000
+
+	mempoolTxn("parent", 0.001, 0)
+	mempoolTxn("first", 0.1, 0, "parent")
+	mempoolTxn("second", 0.03, 0, "parent")
+	mempoolTxn("other", 0.02, 0)
+
+	// With the parent and the first child selected, the second child alone pays more than the other transaction,
+	// though it paid less while it carried the cheap parent
+	want := []string{"parent", "first", "second", "other"}
+	if selected, _ := selectTransactions(); fmt.Sprint(selected) != fmt.Sprint(want) {
+		t.Errorf("selected %v, want %v", selected, want)
+	}
+}
+
+func TestNotifyNewTxn(t *testing.T) {
+	resetState(t)
+	config.Mine = true
+	defer func() { config.Mine = false }()
+
+	pending := func() bool {
+		select {
+		case <-templateSignal:
+			return true
+		default:
+			return false
+		}
+	}
+	pending()
+
+	// The template has room, so any transaction is worth a rebuild
+	templateFull = false
+	notifyNewTxn(mempoolTxn("small", 0.0001, 0))
+	if !pending() {
+		t.Error("no rebuild for a template with room")
+	}
+
+	// A full template is only rebuilt for a better fee rate than its lowest
+	templateFull = true
+	templateMinFee = feeRate(Mempool["small"].Fee, txnSize(Mempool["small"])) * 2
+	notifyNewTxn(Mempool["small"])
+	if pending() {
+		t.Error("rebuild for a transaction paying less than the full template")
+	}
+	notifyNewTxn(mempoolTxn("large", 1, 0))
+	if !pending() {
+		t.Error("no rebuild for a transaction paying more than the full template")
+	}
+}
+func TestStartStopMiningConcurrently(t *testing.T) {
+	resetState(t)
+
+	// Sealing fails right away, as the node is not the authority in turn
+	other, _ := peer.IDFromPrivateKey(newKey(t))
+	Engine = &PoaEngine{Authorities: []peer.ID{other}, Self: "self"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			startMining(Block{Block_height: 1})
+		}()
+		go func() {
+			defer wg.Done()
+			stopMining()
+		}()
+	}
+	wg.Wait()
+	stopMining()
+}
+
+func TestStopMiningWaits(t *testing.T) {
+	resetState(t)
+
+	// A difficulty no nonce meets, so only stopping ends the search
+	Engine = &PowEngine{Difficulty: 64, Workers: 2}
+	block, err := createBlock([]string{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startMining(block)
+	done := miningDone
+	stopMining()
+
+	select {
+	case <-done:
+	default:
+		t.Error("mining goroutine still running after stopMining returned")
+	}
+}
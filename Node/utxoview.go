@@ -0,0 +1,109 @@
+package main
+
+// UTXO set seen through the changes of transactions not yet connected to the chain -
+// the earlier transactions of a block, or the mempool
+type UTXOView struct {
+	Created map[string]UTXO        // UTXOs created by the transactions applied to the view
+	Spent   map[string]bool        // UTXOs spent by the transactions applied to the view
+	Pool    map[string]Transaction // Unconfirmed transactions whose outputs can be spent
+	Height  int32                  // Height the outputs of the pool would confirm at
+}
+
+func newUTXOView() *UTXOView {
+	return &UTXOView{
+		Created: map[string]UTXO{},
+		Spent:   map[string]bool{},
+	}
+}
+
+// View spending the outputs of the unconfirmed transactions - the caller holds the lock of the pool
+func newMempoolView(pool map[string]Transaction, height int32) *UTXOView {
+	view := newUTXOView()
+	view.Pool = pool
+	view.Height = height
+	return view
+}
+
+// Find an unspent output, in the view and then in the UTXO set. A nil view is the UTXO set alone.
+func (view *UTXOView) lookup(txnID string, index int32) (UTXO, bool) {
+	key := utxoKey(txnID, index)
+
+	if view != nil {
+		if view.Spent[key] {
+			return UTXO{}, false
+		}
+
+		if utxo, exists := view.Created[key]; exists {
+			return utxo, true
+		}
+	}
+
+	UTXOMutex.RLock()
+	utxo, exists := UTXO_SET[key]
+	UTXOMutex.RUnlock()
+
+	if exists {
+		return utxo, true
+	}
+
+	// Outputs of the unconfirmed parents
+	if view != nil && view.Pool != nil {
+		parent, exists := view.Pool[txnID]
+		if exists && index >= 0 && int(index) < len(parent.Outputs) {
+			return newUTXO(txnID, index, parent.Outputs[index], view.Height), true
+		}
+	}
+
+	return UTXO{}, false
+}
+
+// Spend the inputs and create the outputs of the transaction in the view
+func (view *UTXOView) apply(txn Transaction, height int32) {
+	for _, input := range txn.Inputs {
+		key := utxoKey(input.Txn_id, input.Index)
+		delete(view.Created, key)
+		view.Spent[key] = true
+	}
+
+	for idx, output := range txn.Outputs {
+		key := utxoKey(txn.Txn_id, int32(idx))
+		view.Created[key] = newUTXO(txn.Txn_id, int32(idx), output, height)
+		delete(view.Spent, key)
+	}
+}
+
+// Find an unspent output in the UTXO set or among the outputs of the mempool transactions
+func findUTXO(txnID string, index int32) (UTXO, bool) {
+	MempoolMutex.RLock()
+	defer MempoolMutex.RUnlock()
+
+	return newMempoolView(Mempool, nextBlockHeight()).lookup(txnID, index)
+}
+
+// Find an unspent output by its UTXO hash, in the UTXO set or among the outputs of the mempool transactions
+func findUTXOByKey(key string) (UTXO, bool) {
+	UTXOMutex.RLock()
+	utxo, exists := UTXO_SET[key]
+	UTXOMutex.RUnlock()
+
+	if exists {
+		return utxo, true
+	}
+
+	MempoolMutex.RLock()
+	defer MempoolMutex.RUnlock()
+
+	utxo, exists = Mempool_Outs[key]
+	if !exists {
+		return UTXO{}, false
+	}
+
+	// Already spent by another mempool transaction
+	if _, spent := Mempool_Spends[key]; spent {
+		return UTXO{}, false
+	}
+
+	// Confirmed in the next block at the earliest
+	utxo.Height = nextBlockHeight()
+	return utxo, true
+}
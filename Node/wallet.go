@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// Key of an output in the UTXO set
+func utxoKey(txnID string, index int32) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s:%d", txnID, index)))
+	return hex.EncodeToString(hash[:])
+}
+
+// Hex encoded public key of the wallet, used as the spendable address
+func walletPubkey() string {
+	pubKeyBytes, _ := Wallet_Key.GetPublic().Raw()
+	return hex.EncodeToString(pubKeyBytes)
+}
+
+// Parse a hex encoded secp256k1 public key
+func parsePubkey(pubKeyHex string) (crypto.PubKey, error) {
+	pubKeyBytes, err := hex.DecodeString(pubKeyHex)
+	if err != nil {
+		return nil, fmt.Errorf("public key is not valid hex: %v", err)
+	}
+
+	return crypto.UnmarshalSecp256k1PublicKey(pubKeyBytes)
+}
+
+// Key the coinbase of mined blocks pays - the wallet key unless a valid one is configured
+func minerAddress(configured string) (string, error) {
+	if configured == "" {
+		return walletPubkey(), nil
+	}
+
+	_, err := parsePubkey(configured)
+	if err != nil {
+		return "", err
+	}
+
+	return configured, nil
+}
+
+// Sign the transaction ID with the private key
+func signTxn(txn *Transaction, privKey crypto.PrivKey) (string, error) {
+	signature, err := privKey.Sign([]byte(txn.Txn_id))
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(signature), nil
+}
+
+// Verify a signature over the transaction ID against a hex public key
+func verifyTxnSignature(txn *Transaction, pubKeyHex string, signature string) error {
+	pubKey, err := parsePubkey(pubKeyHex)
+	if err != nil {
+		return err
+	}
+
+	signatureBytes, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("signature is not valid hex: %v", err)
+	}
+
+	valid, err := pubKey.Verify([]byte(txn.Txn_id), signatureBytes)
+	if err != nil || !valid {
+		return fmt.Errorf("invalid signature")
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVerifyTxnSignature(t *testing.T) {
+	key := newKey(t)
+
+	txn := Transaction{Fee: 0.01, Outputs: []Output{{Pubkey: pubkeyHex(key), Value: 1}}, Timestamp: time.Now()}
+	txn.generateTxn()
+
+	signature, err := signTxn(&txn, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyTxnSignature(&txn, pubkeyHex(key), signature); err != nil {
+		t.Errorf("signature of the key rejected: %v", err)
+	}
+	if err := verifyTxnSignature(&txn, pubkeyHex(newKey(t)), signature); err == nil {
+		t.Error("signature accepted for another key")
+	}
+	if err := verifyTxnSignature(&txn, "not hex", signature); err == nil {
+		t.Error("signature accepted for a malformed key")
+	}
+	if err := verifyTxnSignature(&txn, pubkeyHex(key), ""); err == nil {
+		t.Error("missing signature accepted")
+	}
+
+	// The signature commits to the transaction ID
+	changed := txn
+	changed.Fee = 0.001
+	changed.generateTxn()
+	if err := verifyTxnSignature(&changed, pubkeyHex(key), signature); err == nil {
+		t.Error("signature accepted for a changed transaction")
+	}
+}
+
+func TestMinerAddress(t *testing.T) {
+	resetState(t)
+	cold := pubkeyHex(newKey(t))
+
+	tests := []struct {
+		name       string
+		configured string
+		want       string
+		valid      bool
+	}{
+		{"not configured", "", walletPubkey(), true},
+		{"public key", cold, cold, true},
+		{"peer ID", "12D3KooWHbqZxAuwhJ5JBHw4Rb6nKtv2GzHGrwVvXdiWxWG1Cnqq", "", false},
+		{"truncated key", cold[:20], "", false},
+	}
+
+	for _, test := range tests {
+		address, err := minerAddress(test.configured)
+		if (err == nil) != test.valid || address != test.want {
+			t.Errorf("%s: address %q, %v, want %q, valid = %v", test.name, address, err, test.want, test.valid)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Versions of the wire format, negotiated through the protocol IDs of the streams
+const (
+	wireLegacy = 1 // Newline delimited JSON - kept for one release for the older nodes
+	wireFramed = 2 // Length prefixed frames of a message type and a CBOR payload
+)
+
+// Suffix of the protocol IDs speaking the framed wire
+const framedSuffix = "/2"
+
+// Message types of the framed wire
+const (
+	msgNotFound     byte = iota + 1 // Nothing matches the request
+	msgCount                        // Number of the messages that follow
+	msgID                           // Transaction or block hash
+	msgText                         // Direct chat message
+	msgMessage                      // Gossip message
+	msgTransaction                  // Full transaction
+	msgBlock                        // Full block
+	msgBlockDTO                     // Block announcement with the transaction IDs
+	msgHeader                       // Block header
+	msgBlockRequest                 // Request for a block or a range of blocks
+	msgLocator                      // Block locator of the headers sync
+	msgProof                        // Transaction with its inclusion proof
+	msgHandshake                    // Version, chain and services of a node
+)
+
+// Largest frame accepted, enough for a full block
+const maxFrameSize = 8 << 20
+
+var (
+	errNotFound   = errors.New("not found")
+	errBadMessage = errors.New("bad message") // The stream can still be read after it
+)
+
+// CBOR keeps the full precision of the timestamps, as the hashes commit to them
+var cborMode = func() cbor.EncMode {
+	mode, err := cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	return mode
+}()
+
+// Message reader and writer of a stream, in the wire format negotiated for it
+type Wire struct {
+	rw      *bufio.ReadWriter
+	Version int
+}
+
+func newWire(stream network.Stream) *Wire {
+	version := wireLegacy
+	if strings.HasSuffix(string(stream.Protocol()), framedSuffix) {
+		version = wireFramed
+	}
+
+	return &Wire{
+		rw:      bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream)),
+		Version: version,
+	}
+}
+
+// Protocol IDs of a node protocol, the preferred version first
+func wireProtocols(path string) []protocol.ID {
+	return []protocol.ID{
+		protocol.ID(config.ProtocolID + path + framedSuffix),
+		protocol.ID(config.ProtocolID + path),
+	}
+}
+
+// Serve a node protocol in every wire version, within the stream limits of the protocol
+func setWireHandler(path string, handler network.StreamHandler) {
+	handler = limitStreams(path, handler)
+	for _, id := range wireProtocols(path) {
+		User.SetStreamHandler(id, handler)
+	}
+}
+
+// Serve a protocol of the previous release, which only speaks the legacy wire
+func setLegacyHandler(path string, handler network.StreamHandler) {
+	User.SetStreamHandler(protocol.ID(config.ProtocolID+path), limitStreams(path, handler))
+}
+
+// Open a stream for a node protocol, letting the peer pick the newest wire version it speaks
+func openStream(ctx context.Context, peerID peer.ID, path string) (network.Stream, *Wire, error) {
+	stream, err := User.NewStream(ctx, peerID, wireProtocols(path)...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return stream, newWire(stream), nil
+}
+
+// Queue a message. The legacy lines carry no type - strings and counts are sent as they are, the rest as JSON.
+func (wire *Wire) Write(msgType byte, value any) error {
+	if wire.Version == wireLegacy {
+		return wire.writeLine(msgType, value)
+	}
+
+	payload, err := cborMode.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %v", err)
+	}
+
+	if len(payload)+1 > maxFrameSize {
+		return fmt.Errorf("message of %d bytes is larger than a frame", len(payload))
+	}
+
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)+1))
+	header[4] = msgType
+
+	_, err = wire.rw.Write(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = wire.rw.Write(payload)
+	return err
+}
+
+func (wire *Wire) writeLine(msgType byte, value any) error {
+	var line string
+
+	switch v := value.(type) {
+	case string:
+		line = v
+	case int:
+		line = strconv.Itoa(v)
+	default:
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("failed to encode message: %v", err)
+		}
+		line = string(data)
+	}
+
+	if msgType == msgNotFound {
+		line = "notfound"
+	}
+
+	_, err := wire.rw.WriteString(line + "\n")
+	return err
+}
+
+// Send the queued messages
+func (wire *Wire) Flush() error {
+	return wire.rw.Flush()
+}
+
+// Read the next message into value, which must be of the expected type.
+// Reports errNotFound when the peer answered that nothing matches.
+func (wire *Wire) Read(msgType byte, value any) error {
+	if wire.Version == wireLegacy {
+		return wire.readLine(value)
+	}
+
+	header := make([]byte, 4)
+	_, err := io.ReadFull(wire.rw, header)
+	if err != nil {
+		return err
+	}
+
+	size := binary.BigEndian.Uint32(header)
+	if size < 1 || size > maxFrameSize {
+		return fmt.Errorf("invalid frame size %d", size)
+	}
+
+	frame := make([]byte, size)
+	_, err = io.ReadFull(wire.rw, frame)
+	if err != nil {
+		return err
+	}
+
+	if frame[0] == msgNotFound {
+		return errNotFound
+	}
+
+	if frame[0] != msgType {
+		return fmt.Errorf("%w: expected message type %d, received %d", errBadMessage, msgType, frame[0])
+	}
+
+	err = cbor.Unmarshal(frame[1:], value)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errBadMessage, err)
+	}
+
+	return nil
+}
+
+// Read one legacy line, which like a frame may not be longer than maxFrameSize
+func (wire *Wire) readRawLine() (string, error) {
+	line := []byte{}
+	for {
+		chunk, err := wire.rw.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxFrameSize {
+			return "", fmt.Errorf("line longer than %d bytes", maxFrameSize)
+		}
+
+		// The buffer filled up before the end of the line
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		return string(line), nil
+	}
+}
+
+func (wire *Wire) readLine(value any) error {
+	// Skip the blank lines
+	line := ""
+	for line == "" {
+		data, err := wire.readRawLine()
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(data)
+	}
+
+	if line == "notfound" {
+		return errNotFound
+	}
+
+	switch v := value.(type) {
+	case *string:
+		*v = line
+	case *int:
+		count, err := strconv.Atoi(line)
+		if err != nil {
+			return fmt.Errorf("%w: invalid count %q", errBadMessage, line)
+		}
+		*v = count
+	default:
+		err := json.Unmarshal([]byte(line), value)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errBadMessage, err)
+		}
+	}
+
+	return nil
+}
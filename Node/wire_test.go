@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Wire over an in-memory buffer
+func bufferWire(version int) (*Wire, *bytes.Buffer) {
+	buffer := &bytes.Buffer{}
+	return &Wire{rw: bufio.NewReadWriter(bufio.NewReader(buffer), bufio.NewWriter(buffer)), Version: version}, buffer
+}
+
+func TestWireRoundTrip(t *testing.T) {
+	block := Block{
+		Block_height:  7,
+		Previous_hash: "parent",
+		Timestamp:     time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC),
+		Transactions:  []Transaction{{Txn_id: "coinbase", Outputs: []Output{{Pubkey: "key", Value: 1.5}}}},
+	}
+	block.generateBlockHash()
+
+	for _, version := range []int{wireLegacy, wireFramed} {
+		wire, _ := bufferWire(version)
+		wire.Write(msgCount, 2)
+		wire.Write(msgID, "txn")
+		wire.Write(msgBlock, block)
+		wire.Write(msgNotFound, nil)
+		if err := wire.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		var count int
+		var txnID string
+		var received Block
+		for _, err := range []error{wire.Read(msgCount, &count), wire.Read(msgID, &txnID), wire.Read(msgBlock, &received)} {
+			if err != nil {
+				t.Fatalf("version %d: %v", version, err)
+			}
+		}
+		if count != 2 || txnID != "txn" {
+			t.Errorf("version %d: read %d and %q", version, count, txnID)
+		}
+
+		// The hash commits to the timestamp, so it has to survive to the nanosecond
+		expected := received
+		expected.generateBlockHash()
+		if expected.Block_hash != block.Block_hash || received.Transactions[0].Outputs[0].Value != 1.5 {
+			t.Errorf("version %d: block changed on the wire", version)
+		}
+
+		if err := wire.Read(msgBlock, &received); err != errNotFound {
+			t.Errorf("version %d: read %v, want not found", version, err)
+		}
+	}
+}
+
+func TestWireBadMessages(t *testing.T) {
+	wire, buffer := bufferWire(wireFramed)
+
+	// A message of an unexpected type is skipped, leaving the stream readable
+	wire.Write(msgID, "txn")
+	wire.Write(msgCount, 1)
+	wire.Flush()
+
+	var block Block
+	if err := wire.Read(msgBlock, &block); !errors.Is(err, errBadMessage) {
+		t.Errorf("read %v for a message of another type, want a bad message", err)
+	}
+	var count int
+	if err := wire.Read(msgCount, &count); err != nil || count != 1 {
+		t.Errorf("read %d, %v after a bad message", count, err)
+	}
+
+	// Frames larger than a block are refused before they are read
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header, maxFrameSize+1)
+	buffer.Write(header)
+	if err := wire.Read(msgBlock, &block); err == nil {
+		t.Error("oversized frame accepted")
+	}
+
+	if err := wire.Write(msgID, string(make([]byte, maxFrameSize))); err == nil {
+		t.Error("oversized message written")
+	}
+}
+
+func TestWireLegacyLines(t *testing.T) {
+	// A line longer than the read buffer is still read whole
+	wire, buffer := bufferWire(wireLegacy)
+	long := strings.Repeat("a", 64*1024)
+	wire.Write(msgID, long)
+	wire.Flush()
+
+	var txnID string
+	if err := wire.Read(msgID, &txnID); err != nil || txnID != long {
+		t.Errorf("read %d bytes, %v, want the %d bytes written", len(txnID), err, len(long))
+	}
+
+	// Lines larger than a frame are refused
+	buffer.WriteString(strings.Repeat("a", maxFrameSize+1) + "\n")
+	if err := wire.Read(msgID, &txnID); err == nil {
+		t.Error("oversized line accepted")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	work "blockchain-app/Work"
+)
+
+// Most jobs kept for the external miners - the oldest are forgotten first
+const maxWorkJobs = 64
+
+var (
+	workMutex sync.Mutex
+	workJobs  map[string]Block = map[string]Block{} // Templates handed out, by job ID
+	workNonce int32                                 // Extra nonce of the last job, so that no two jobs share a header
+
+	// Last template built, reused while the tip and the mempool stay the same
+	workTemplate    Block
+	workTemplateTip string
+	workTemplateGen uint64
+)
+
+// Serve the work protocol for the external miners
+func startWorkServer(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/work", getWork)
+	mux.HandleFunc("/submit", submitWork)
+
+	logger.Info("Serving mining work on ", address)
+
+	err := http.ListenAndServe(address, mux)
+	if err != nil {
+		fmt.Println("Work server stopped:", err)
+	}
+}
+
+// Hand out a header template built from the mempool
+func getWork(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, ok := Engine.(*PowEngine); !ok {
+		http.Error(w, "the work protocol needs the proof-of-work engine", http.StatusBadRequest)
+		return
+	}
+
+	block, err := cachedTemplate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	workMutex.Lock()
+
+	// Jobs on an old tip can no longer be submitted
+	for jobID, job := range workJobs {
+		if job.Previous_hash != block.Previous_hash {
+			delete(workJobs, jobID)
+		}
+	}
+
+	// Give every job its own coinbase, so the miners search different headers
+	workNonce++
+	block.Transactions[0].Extra_nonce = workNonce
+	block.Transactions[0].generateTxn()
+	block.Merkle_hash = buildMerkle(block.Transactions).Value
+
+	// Forget the oldest jobs past the limit
+	for len(workJobs) >= maxWorkJobs {
+		delete(workJobs, oldestJob())
+	}
+
+	jobID := strconv.Itoa(int(workNonce))
+	workJobs[jobID] = block
+
+	workMutex.Unlock()
+
+	prefix, suffix := block.headerParts()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(work.Template{
+		Job_id:        jobID,
+		Block_height:  block.Block_height,
+		Previous_hash: block.Previous_hash,
+		Difficulty:    block.Difficulty,
+		Prefix:        prefix,
+		Suffix:        suffix,
+	})
+}
+
+// Template for the next job - only rebuilt once the tip or the mempool changed since the last one
+func cachedTemplate() (Block, error) {
+	// Read before building, so that a change during the build forces the next rebuild
+	BlockMutex.RLock()
+	tip := Latest_Block
+	BlockMutex.RUnlock()
+
+	MempoolMutex.RLock()
+	gen := Mempool_Gen
+	MempoolMutex.RUnlock()
+
+	workMutex.Lock()
+	cached := workTemplateTip == tip && workTemplateGen == gen
+	block := workTemplate
+	workMutex.Unlock()
+
+	if !cached {
+		var err error
+		block, err = buildTemplate()
+		if err != nil {
+			return Block{}, fmt.Errorf("failed to build block template: %w", err)
+		}
+
+		err = Engine.Prepare(&block)
+		if err != nil {
+			return Block{}, fmt.Errorf("failed to prepare block: %w", err)
+		}
+
+		workMutex.Lock()
+		workTemplate, workTemplateTip, workTemplateGen = block, tip, gen
+		workMutex.Unlock()
+	}
+
+	// The jobs roll their own coinbase, so they must not share the transactions
+	block.Transactions = append([]Transaction{}, block.Transactions...)
+	return block, nil
+}
+
+// Job handed out first among the ones kept - the caller holds workMutex
+func oldestJob() string {
+	oldest, oldestNonce := "", 0
+	for jobID := range workJobs {
+		nonce, _ := strconv.Atoi(jobID)
+		if oldest == "" || nonce < oldestNonce {
+			oldest, oldestNonce = jobID, nonce
+		}
+	}
+	return oldest
+}
+
+// Accept a solved nonce, and add and broadcast the block the same way as a locally mined one
+func submitWork(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var submission work.Submission
+	err := json.NewDecoder(r.Body).Decode(&submission)
+	if err != nil {
+		http.Error(w, "failed to parse submission: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	workMutex.Lock()
+	block, exists := workJobs[submission.Job_id]
+	workMutex.Unlock()
+
+	result := work.Result{}
+
+	if !exists {
+		result.Error = "unknown or stale job"
+	} else {
+		block.Nonce = submission.Nonce
+		block.generateBlockHash()
+
+		if !strings.HasPrefix(block.Block_hash, strings.Repeat("0", int(block.Difficulty))) {
+			result.Error = "hash does not meet the difficulty"
+		} else if err := submitBlock(block); err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Accepted = true
+			result.Block_hash = block.Block_hash
+
+			workMutex.Lock()
+			delete(workJobs, submission.Job_id)
+			workMutex.Unlock()
+
+			logger.Info("Block mined by an external miner: ", block.Block_hash)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
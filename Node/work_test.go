@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	work "blockchain-app/Work"
+)
+
+func requestWork(t *testing.T) work.Template {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	getWork(recorder, httptest.NewRequest(http.MethodGet, "/work", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("GET /work: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	var template work.Template
+	if err := json.NewDecoder(recorder.Body).Decode(&template); err != nil {
+		t.Fatal(err)
+	}
+	return template
+}
+
+func submitNonce(t *testing.T, jobID string, nonce int32) work.Result {
+	t.Helper()
+
+	data, _ := json.Marshal(work.Submission{Job_id: jobID, Nonce: nonce})
+	recorder := httptest.NewRecorder()
+	submitWork(recorder, httptest.NewRequest(http.MethodPost, "/submit", bytes.NewReader(data)))
+
+	var result work.Result
+	if err := json.NewDecoder(recorder.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestWorkJobsAreBounded(t *testing.T) {
+	resetState(t)
+	config.MinerAddress = walletPubkey()
+
+	first := requestWork(t)
+	last := first
+	for i := 0; i < maxWorkJobs+10; i++ {
+		last = requestWork(t)
+	}
+
+	if len(workJobs) != maxWorkJobs {
+		t.Fatalf("%d jobs kept, want %d", len(workJobs), maxWorkJobs)
+	}
+	if _, exists := workJobs[first.Job_id]; exists {
+		t.Error("oldest job kept past the limit")
+	}
+	if _, exists := workJobs[last.Job_id]; !exists {
+		t.Error("latest job forgotten")
+	}
+	if result := submitNonce(t, first.Job_id, 0); result.Accepted || result.Error == "" {
+		t.Errorf("forgotten job accepted: %+v", result)
+	}
+}
+
+func TestWorkTemplateCached(t *testing.T) {
+	resetState(t)
+	config.MinerAddress = walletPubkey()
+	config.MaxBlockTxns = 10
+	config.MaxBlockSize = 1000000
+
+	// The template keeps its timestamp while the tip and the mempool stay the same
+	first, second := requestWork(t), requestWork(t)
+	if first.Suffix != second.Suffix {
+		t.Error("template rebuilt without a change")
+	}
+
+	if err := acceptToMempool(fundedSpend(t, "funding", 0.01)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if third := requestWork(t); third.Suffix == second.Suffix {
+		t.Error("template kept after a mempool change")
+	}
+	if cached := workTemplate; len(cached.Transactions) != 2 || cached.Transactions[0].Extra_nonce != 0 {
+		t.Errorf("cached template with %d transactions, or a rolled coinbase", len(cached.Transactions))
+	}
+}
+
+// An external miner fetches a header, solves it, and the node adds the block
+func TestSubmitWork(t *testing.T) {
+	resetState(t)
+	config.MinerAddress = walletPubkey()
+
+	template := requestWork(t)
+	other := requestWork(t)
+	if template.Job_id == other.Job_id || template.Prefix == other.Prefix {
+		t.Fatal("two jobs share a header")
+	}
+
+	target := strings.Repeat("0", int(template.Difficulty))
+	nonce, bad := int32(0), int32(-1)
+	for ; !strings.HasPrefix(hashHeader(template.Prefix, nonce, template.Suffix), target); nonce++ {
+		bad = nonce
+	}
+
+	if bad >= 0 {
+		if result := submitNonce(t, template.Job_id, bad); result.Accepted {
+			t.Fatal("nonce missing the difficulty accepted")
+		}
+	}
+
+	result := submitNonce(t, template.Job_id, nonce)
+	if !result.Accepted {
+		t.Fatalf("solved job rejected: %s", result.Error)
+	}
+	if Latest_Block != result.Block_hash || tipBlock().Block_height != template.Block_height {
+		t.Errorf("tip %s at height %d, want the submitted block at height %d", Latest_Block, tipBlock().Block_height, template.Block_height)
+	}
+
+	// The other job builds on the old tip
+	if result := submitNonce(t, other.Job_id, nonce); result.Accepted {
+		t.Error("job on the old tip accepted")
+	}
+	if result := submitNonce(t, template.Job_id, nonce); result.Accepted || result.Error == "" {
+		t.Errorf("job submitted twice: %+v", result)
+	}
+}
+
+func TestWorkMethods(t *testing.T) {
+	resetState(t)
+
+	recorder := httptest.NewRecorder()
+	getWork(recorder, httptest.NewRequest(http.MethodPost, "/work", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /work: %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	submitWork(recorder, httptest.NewRequest(http.MethodGet, "/submit", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /submit: %d", recorder.Code)
+	}
+
+	// Sealing by signature leaves nothing to hash
+	Engine = &PoaEngine{}
+	recorder = httptest.NewRecorder()
+	getWork(recorder, httptest.NewRequest(http.MethodGet, "/work", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("GET /work on proof-of-authority: %d", recorder.Code)
+	}
+}
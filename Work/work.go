@@ -0,0 +1,98 @@
+package work
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Nonces a worker tries between checks for cancellation
+const nonceBatch = 4096
+
+// Block header handed to an external miner
+type Template struct {
+	Job_id        string `json:"job_id"`
+	Block_height  int32  `json:"block_height"`
+	Previous_hash string `json:"previous_hash"`
+	Difficulty    int32  `json:"difficulty"`
+	Prefix        string `json:"prefix"` // Header data hashed before the nonce
+	Suffix        string `json:"suffix"` // Header data hashed after the nonce
+}
+
+// Nonce found by an external miner
+type Submission struct {
+	Job_id string `json:"job_id"`
+	Nonce  int32  `json:"nonce"`
+}
+
+type Result struct {
+	Accepted   bool   `json:"accepted"`
+	Block_hash string `json:"block_hash,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Hash of the header data with the nonce - the node and the external miners must agree on it
+func HashHeader(prefix string, nonce int32, suffix string) string {
+	hash := sha256.Sum256([]byte(prefix + strconv.Itoa(int(nonce)) + suffix))
+	return fmt.Sprintf("%x", hash)
+}
+
+// Search the whole nonce space of the header across the workers, stopping early when the context is cancelled.
+// Returns the nonce meeting the difficulty and the hash it gives, if one was found.
+func Search(ctx context.Context, prefix string, suffix string, difficulty int32, workers int) (int32, string, bool) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	target := strings.Repeat("0", int(difficulty))
+
+	// Stops the other workers once a nonce is found
+	searchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg    sync.WaitGroup
+		once  sync.Once
+		found bool
+		nonce int32
+		hash  string
+	)
+
+	// Worker w tries the nonces w, w + workers, w + 2 * workers...
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(start int64) {
+			defer wg.Done()
+
+			for candidate := start; candidate <= math.MaxInt32; {
+				select {
+				case <-searchCtx.Done():
+					return
+				default:
+				}
+
+				for i := 0; i < nonceBatch && candidate <= math.MaxInt32; i++ {
+					candidateHash := HashHeader(prefix, int32(candidate), suffix)
+
+					if strings.HasPrefix(candidateHash, target) {
+						once.Do(func() {
+							found = true
+							nonce = int32(candidate)
+							hash = candidateHash
+							cancel()
+						})
+						return
+					}
+					candidate += int64(workers)
+				}
+			}
+		}(int64(math.MinInt32) + int64(w))
+	}
+
+	wg.Wait()
+	return nonce, hash, found
+}